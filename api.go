@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// apiV2Prefix is the path of versioned API relative to stopwatch prefix.
+// Unversioned endpoints (/time, /start, ...) are kept for old clients
+// and accept any method
+const apiV2Prefix = "/api/v2"
+
+// codes of API errors
+const (
+	errCodeBadRequest       = "bad_request"
+	errCodeValidation       = "validation_failed"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeForbidden        = "forbidden"
+	errCodeNotFound         = "not_found"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeConflict         = "conflict"
+	errCodeInternal         = "internal_error"
+	errCodeUnavailable      = "unavailable"
+)
+
+// APIError is a body of API error responses
+// Code is a stable machine-readable error kind, Message is for humans
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// serveAPIv2 serves /api/v2 requests of a stopwatch, path of r
+// is relative to API prefix. Actions changing stopwatch state require POST
+func (srv *Server) serveAPIv2(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	p := r.URL.Path
+
+	switch {
+	case p == "/time":
+		if allowMethods(w, r, http.MethodGet) {
+			srv.handleTime(w, r, sw)
+		}
+	case p == "/start":
+		if allowMethods(w, r, http.MethodPost) {
+			srv.handleStart(w, r, sw)
+		}
+	case p == "/stop":
+		if allowMethods(w, r, http.MethodPost) {
+			srv.handleStop(w, r, sw)
+		}
+	case p == "/undo":
+		if allowMethods(w, r, http.MethodPost) {
+			srv.handleUndo(w, r, sw)
+		}
+	case p == "/redo":
+		if allowMethods(w, r, http.MethodPost) {
+			srv.handleRedo(w, r, sw)
+		}
+	case p == "/sessions":
+		srv.handleSessions(w, r, sw)
+	case strings.HasPrefix(p, "/sessions/"):
+		srv.handleSession(w, r, sw)
+	case p == "/stat":
+		if allowMethods(w, r, http.MethodGet) {
+			srv.handleStat(w, r, sw)
+		}
+	case strings.HasPrefix(p, "/export/"):
+		if allowMethods(w, r, http.MethodGet) {
+			srv.handleExport(w, r, sw)
+		}
+	case p == "/import":
+		srv.handleImport(w, r, sw)
+	case p == "/calendar-url":
+		if allowMethods(w, r, http.MethodGet) {
+			srv.handleCalendarURL(w, r, sw)
+		}
+	case p == "/updates":
+		if allowMethods(w, r, http.MethodGet) {
+			srv.handleUpdates(w, r, sw, true)
+		}
+	case p == "/events":
+		if allowMethods(w, r, http.MethodGet) {
+			srv.handleEvents(w, r, sw)
+		}
+	default:
+		writeError(w, http.StatusNotFound, errCodeNotFound, "unknown API endpoint "+p)
+	}
+}
+
+// withPath returns a shallow copy of request with another URL path
+func withPath(r *http.Request, p string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = p
+	r2.URL = &u
+
+	return r2
+}
+
+// allowMethods writes 405 response and returns false
+// if request method is not one of allowed
+func allowMethods(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, method := range allowed {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	methodNotAllowed(w, allowed...)
+	return false
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSONStatus(w, status, &APIError{Code: code, Message: message})
+}
+
+// writeInternalError logs an error and writes 500 response
+// with a message that doesn't expose error details
+func writeInternalError(w http.ResponseWriter, message string, err error) {
+	log.Printf("%s: %s\n", message, err)
+	writeError(w, http.StatusInternalServerError, errCodeInternal, message)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("failed to marshal response: %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_, err = w.Write(data)
+	if err != nil {
+		log.Printf("failed to write response: %s\n", err)
+	}
+}
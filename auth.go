@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuthCache remembers credentials that passed bcrypt check,
+// so that bcrypt is not computed on every request of a browser.
+// Keys are SHA-256 sums of user name and password
+type basicAuthCache struct {
+	lock  sync.Mutex
+	valid map[[sha256.Size]byte]bool
+}
+
+func (c *basicAuthCache) check(cfg *AuthConfig, name string, password string) bool {
+	key := sha256.Sum256([]byte(name + "\x00" + password))
+
+	c.lock.Lock()
+	valid := c.valid[key]
+	c.lock.Unlock()
+
+	if valid {
+		return true
+	}
+
+	hash, ok := cfg.Users[name]
+	if !ok || bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	c.lock.Lock()
+	if c.valid == nil {
+		c.valid = make(map[[sha256.Size]byte]bool)
+	}
+	c.valid[key] = true
+	c.lock.Unlock()
+
+	return true
+}
+
+// authorized tells if request passes HTTP authentication set in [http.auth] config.
+// Request is authorized with basic auth of a configured user, with one of configured
+// tokens, or with a token of a user in multi-user mode. A valid token passed
+// as parameter is saved to cookie for browsers
+func (srv *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	cfg := srv.config.HTTP.Auth
+	if cfg == nil || !cfg.Enabled {
+		return true
+	}
+
+	token := tokenFromRequest(r)
+	if srv.isAdmin(r) {
+		srv.rememberToken(w, r, token)
+		return true
+	}
+
+	if token == "" {
+		return false
+	}
+
+	if srv.config.HTTP.MultiUser {
+		user, err := srv.store.UserByTokenHash(hashToken(token))
+		return err == nil && user != nil
+	}
+
+	return false
+}
+
+// isAdmin tells if request has credentials of a user or a token from [http.auth] config.
+// Tokens of users of multi-user mode don't make an administrator
+func (srv *Server) isAdmin(r *http.Request) bool {
+	cfg := srv.config.HTTP.Auth
+	if cfg == nil || !cfg.Enabled {
+		return false
+	}
+
+	if name, password, ok := r.BasicAuth(); ok && srv.basicAuth.check(cfg, name, password) {
+		return true
+	}
+
+	token := tokenFromRequest(r)
+	if token == "" {
+		return false
+	}
+
+	for _, allowed := range cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireAdmin writes 403 response and returns false if request is not made
+// by administrator. Server-wide endpoints are not available at all
+// when HTTP authentication is disabled
+func (srv *Server) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	cfg := srv.config.HTTP.Auth
+	if cfg == nil || !cfg.Enabled {
+		writeError(w, http.StatusForbidden, errCodeForbidden, "enable HTTP authentication in http.auth config to use this endpoint")
+		return false
+	}
+
+	if !srv.isAdmin(r) {
+		writeError(w, http.StatusForbidden, errCodeForbidden, "credentials from http.auth config are required")
+		return false
+	}
+
+	return true
+}
+
+// requireAuth writes 401 response asking for credentials
+func requireAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="stopwatch"`)
+	w.Header().Add("WWW-Authenticate", `Bearer realm="stopwatch"`)
+	writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "authentication required")
+}
+
+// rememberToken saves token passed as parameter to cookie,
+// so that browsers send it with API requests made by UI.
+// The cookie is not sent with requests from other sites
+// and is limited to HTTPS if the token came over HTTPS
+func (srv *Server) rememberToken(w http.ResponseWriter, r *http.Request, token string) {
+	if r.URL.Query().Get("token") != token {
+		return
+	}
+
+	cookiePath := srv.config.HTTP.HrefPrefix
+	if cookiePath == "" {
+		cookiePath = "/"
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    token,
+		Path:     cookiePath,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// setAuthHeader adds credentials from client config to request,
+// token is preferred over user and password
+func setAuthHeader(req *http.Request, cfg *ClientConfig) {
+	if cfg == nil {
+		return
+	}
+
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	} else if cfg.User != "" {
+		req.SetBasicAuth(cfg.User, cfg.Password)
+	}
+}
+
+// clientCredentials returns client config with credentials
+// overridden by STOPWATCH_TOKEN, STOPWATCH_USER and STOPWATCH_PASSWORD
+// environment variables
+func clientCredentials(cfg *ClientConfig) *ClientConfig {
+	creds := &ClientConfig{}
+	if cfg != nil {
+		*creds = *cfg
+	}
+
+	if token := os.Getenv("STOPWATCH_TOKEN"); token != "" {
+		creds.Token = token
+	}
+
+	if user := os.Getenv("STOPWATCH_USER"); user != "" {
+		creds.User = user
+		creds.Password = os.Getenv("STOPWATCH_PASSWORD")
+	}
+
+	return creds
+}
+
+// runHashPassword reads a password from stdin and prints its bcrypt hash
+// for [http.auth.users] config section, used in -hash-password mode
+func runHashPassword() error {
+	fmt.Fprint(os.Stderr, "password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return fmt.Errorf("read password: %s", err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(password, "\r\n")), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(hash))
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenCookie(t *testing.T) {
+	srv := newTestServer(t, NewFakeClock(at(0, 12, 0)), func(cfg *Config) {
+		cfg.HTTP.MultiUser = false
+		cfg.HTTP.Auth.Enabled = true
+		cfg.HTTP.Auth.Tokens = []string{testAdminToken}
+	})
+
+	request := func(method string, url string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	resp := request(http.MethodGet, apiV2Prefix+"/time?token="+testAdminToken, nil)
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("%d cookies are set", len(cookies))
+	}
+
+	cookie := cookies[0]
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode || cookie.Secure {
+		t.Errorf("cookie is %s", cookie)
+	}
+
+	resp = request(http.MethodGet, "https://example.com"+apiV2Prefix+"/time?token="+testAdminToken, nil)
+	cookies = resp.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].Secure {
+		t.Errorf("cookies over HTTPS are %v", cookies)
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{http.MethodGet, apiV2Prefix + "/time", http.StatusOK},
+		{http.MethodPost, apiV2Prefix + "/start", http.StatusOK},
+		{http.MethodGet, "/start", http.StatusUnauthorized},
+		{http.MethodGet, "/w/study/stop", http.StatusUnauthorized},
+		{http.MethodGet, "/undo", http.StatusUnauthorized},
+		{http.MethodGet, "/redo", http.StatusUnauthorized},
+		{http.MethodGet, "/time", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		resp := request(test.method, test.url, &http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		if resp.Code != test.status {
+			t.Errorf("%s %s with cookie: status %d, expected %d", test.method, test.url, resp.Code, test.status)
+		}
+	}
+}
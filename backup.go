@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// backupFormat identifies stopwatch backup files,
+// backupVersion is incremented on incompatible changes of the format
+const (
+	backupFormat  = "stopwatch-backup"
+	backupVersion = 1
+)
+
+// maximum size of restored backup sent over HTTP
+const maxRestoreSize = 256 << 20
+
+// Backup is a storage-independent copy of all users and sessions.
+// Times are Unix timestamps in milliseconds. The journal is not
+// included as it refers to sessions by IDs that change on merge
+type Backup struct {
+	Format   string          `json:"format"`
+	Version  int             `json:"version"`
+	Created  int64           `json:"created"`
+	Users    []BackupUser    `json:"users"`
+	Sessions []BackupSession `json:"sessions"`
+}
+
+// BackupUser is a user in backup, only token hash is kept as in the store
+type BackupUser struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	TokenHash string `json:"token_hash"`
+	Created   int64  `json:"created"`
+}
+
+// BackupSession is a session in backup with its scope,
+// user ID 0 is the anonymous user of single-user mode, End is null for opened session
+type BackupSession struct {
+	UserID  int64    `json:"user_id"`
+	Timer   string   `json:"timer"`
+	ID      int64    `json:"id"`
+	Start   int64    `json:"start"`
+	End     *int64   `json:"end"`
+	Project string   `json:"project"`
+	Tags    []string `json:"tags"`
+	Note    string   `json:"note"`
+}
+
+// RestoreResult is a summary of restore
+// Skipped is the number of merged sessions that overlap with existing ones
+type RestoreResult struct {
+	Users    int `json:"users"`
+	Sessions int `json:"sessions"`
+	Skipped  int `json:"skipped"`
+}
+
+func newBackup() *Backup {
+	return &Backup{
+		Format:   backupFormat,
+		Version:  backupVersion,
+		Created:  millis(time.Now()),
+		Users:    []BackupUser{},
+		Sessions: []BackupSession{},
+	}
+}
+
+func backupSession(scope Scope, s *Session) BackupSession {
+	bs := BackupSession{
+		UserID:  scope.UserID,
+		Timer:   scope.Timer,
+		ID:      s.ID,
+		Start:   millis(s.Start),
+		Project: s.Project,
+		Tags:    s.Tags,
+		Note:    s.Note,
+	}
+
+	if bs.Tags == nil {
+		bs.Tags = []string{}
+	}
+
+	if !s.Opened {
+		end := millis(s.End)
+		bs.End = &end
+	}
+
+	return bs
+}
+
+// Session returns session of backup, ID is kept
+func (bs BackupSession) Session() *Session {
+	s := &Session{
+		ID:      bs.ID,
+		Start:   millisToTime(bs.Start),
+		Project: bs.Project,
+		Tags:    bs.Tags,
+		Note:    bs.Note,
+		Opened:  bs.End == nil,
+	}
+
+	if bs.End != nil {
+		s.End = millisToTime(*bs.End)
+	}
+
+	return s
+}
+
+// validate checks backup before it's restored,
+// so that restore does not fail in the middle
+func (b *Backup) validate() error {
+	if b.Format != backupFormat {
+		return fmt.Errorf("not a stopwatch backup")
+	}
+
+	if b.Version < 1 || b.Version > backupVersion {
+		return fmt.Errorf("unsupported backup version %d", b.Version)
+	}
+
+	users := map[int64]bool{0: true}
+	names := map[string]bool{}
+	for _, u := range b.Users {
+		if u.ID <= 0 || u.Name == "" || u.TokenHash == "" {
+			return fmt.Errorf("invalid user %d %s", u.ID, u.Name)
+		}
+		if users[u.ID] || names[u.Name] {
+			return fmt.Errorf("duplicate user %d %s", u.ID, u.Name)
+		}
+		users[u.ID] = true
+		names[u.Name] = true
+	}
+
+	ids := map[int64]bool{}
+	for _, s := range b.Sessions {
+		if !users[s.UserID] {
+			return fmt.Errorf("session %d belongs to unknown user %d", s.ID, s.UserID)
+		}
+		if !timerNameRe.MatchString(s.Timer) {
+			return fmt.Errorf("session %d has invalid stopwatch name %s", s.ID, s.Timer)
+		}
+		if s.ID <= 0 || ids[s.ID] {
+			return fmt.Errorf("invalid or duplicate session id %d", s.ID)
+		}
+		if s.End != nil && *s.End < s.Start {
+			return fmt.Errorf("session %d ends before its start", s.ID)
+		}
+		ids[s.ID] = true
+	}
+
+	return nil
+}
+
+func readBackup(data []byte) (*Backup, error) {
+	b := &Backup{}
+	err := json.Unmarshal(data, b)
+	if err != nil {
+		return nil, fmt.Errorf("parse backup: %s", err)
+	}
+
+	return b, b.validate()
+}
+
+// runBackup writes backup of the store to a file, used in -backup mode
+func runBackup(cfg *DBConfig, path string) error {
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	b, err := store.Backup()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d users and %d sessions saved to %s\n", len(b.Users), len(b.Sessions), path)
+	return nil
+}
+
+// runRestore restores backup from a file to the store, used in -restore mode
+func runRestore(cfg *DBConfig, path string, replace bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	b, err := readBackup(data)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	err = store.Migrate()
+	if err != nil {
+		return err
+	}
+
+	result, err := store.Restore(b, replace)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %d users and %d sessions, %d overlapping sessions skipped\n", result.Users, result.Sessions, result.Skipped)
+	return nil
+}
+
+// handleBackup serves GET /backup, backup has data of all users,
+// so it's allowed to administrators only
+func (srv *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if !srv.requireAdmin(w, r) || !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	b, err := srv.store.Backup()
+	if err != nil {
+		writeInternalError(w, "failed to make backup", err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="stopwatch-backup.json"`)
+	writeJSON(w, b)
+}
+
+// handleRestore serves POST /restore?mode=merge|replace, body is a backup.
+// Stopwatches are reloaded after restore
+func (srv *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if !srv.requireAdmin(w, r) || !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode != "merge" && mode != "replace" {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "mode must be merge or replace")
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRestoreSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "failed to read backup: "+err.Error())
+		return
+	}
+
+	b, err := readBackup(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+		return
+	}
+
+	result, err := srv.store.Restore(b, mode == "replace")
+	if err != nil {
+		writeInternalError(w, "failed to restore backup", err)
+		return
+	}
+
+	writeJSON(w, result)
+	srv.reloadStopwatches()
+}
+
+// reloadStopwatches reloads sessions of all loaded stopwatches
+// after the store was changed bypassing them
+func (srv *Server) reloadStopwatches() {
+	srv.lock.Lock()
+	stopwatches := make([]*Stopwatch, 0, len(srv.stopwatches))
+	for _, loaded := range srv.stopwatches {
+		stopwatches = append(stopwatches, loaded.sw)
+	}
+	srv.lock.Unlock()
+
+	for _, sw := range stopwatches {
+		sw.lock.Lock()
+		err := sw.LoadSessions()
+		sw.lock.Unlock()
+
+		if err != nil {
+			log.Printf("failed to reload stopwatch %s: %s\n", sw.Name, err)
+			continue
+		}
+
+		srv.updated(sw, eventSessionEdited)
+	}
+}
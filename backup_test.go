@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var backupTestDay = time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+
+func backupTestTime(hour int) time.Time {
+	return backupTestDay.Add(time.Duration(hour) * time.Hour)
+}
+
+// backupTestStores returns stores of every driver that can run in tests
+func backupTestStores(t *testing.T) map[string]func() Store {
+	open := func(cfg *DBConfig) Store {
+		store, err := openStore(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return store
+	}
+
+	dir := t.TempDir()
+	n := 0
+
+	return map[string]func() Store{
+		driverMemory: func() Store {
+			return open(&DBConfig{Driver: driverMemory})
+		},
+		driverSQLite: func() Store {
+			n++
+			return open(&DBConfig{Driver: driverSQLite, Path: dir + "/" + string(rune('a'+n)) + ".db"})
+		},
+	}
+}
+
+func addBackupTestUser(t *testing.T, store Store, name string) *User {
+	u := &User{Name: name, TokenHash: name + "-token-hash", Created: backupTestDay}
+	err := store.CreateUser(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+func addBackupTestSession(t *testing.T, store Store, scope Scope, start int, end int, note string) {
+	s := &Session{Start: backupTestTime(start), Opened: end == 0, Project: "work", Tags: []string{"a"}, Note: note}
+	if end > 0 {
+		s.End = backupTestTime(end)
+	}
+
+	err := store.WithScope(scope).InsertSession(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// backupTestNotes returns notes of sessions of a scope in order of start
+func backupTestNotes(t *testing.T, store Store, scope Scope) []string {
+	sessions, err := store.WithScope(scope).Sessions(backupTestDay, backupTestDay.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notes := []string{}
+	for _, s := range sessions {
+		notes = append(notes, s.Note)
+	}
+
+	return notes
+}
+
+func backupTestUsers(t *testing.T, store Store) map[string]int64 {
+	users, err := store.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]int64{}
+	for _, u := range users {
+		ids[u.Name] = u.ID
+	}
+
+	return ids
+}
+
+func checkStrings(t *testing.T, what string, actual []string, expected ...string) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Errorf("%s are %q, expected %q", what, actual, expected)
+		return
+	}
+
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Errorf("%s are %q, expected %q", what, actual, expected)
+			return
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	for driver, open := range backupTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			anonymous := Scope{Timer: defaultTimer}
+
+			// backup has two sessions of single-user mode and a user with a running session
+			source := open()
+			ann := addBackupTestUser(t, source, "ann")
+			addBackupTestSession(t, source, anonymous, 9, 10, "first")
+			addBackupTestSession(t, source, anonymous, 11, 12, "second")
+			addBackupTestSession(t, source, Scope{UserID: ann.ID, Timer: "work"}, 9, 0, "running")
+
+			b, err := source.Backup()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := json.Marshal(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err = readBackup(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// existing data: another user, a duplicate of the first session and another session
+			existing := func() Store {
+				store := open()
+				addBackupTestUser(t, store, "bob")
+				addBackupTestSession(t, store, anonymous, 9, 10, "existing first")
+				addBackupTestSession(t, store, anonymous, 13, 14, "existing")
+				return store
+			}
+
+			t.Run("merge", func(t *testing.T) {
+				store := existing()
+
+				result, err := store.Restore(b, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if *result != (RestoreResult{Users: 1, Sessions: 2, Skipped: 1}) {
+					t.Errorf("result is %+v", result)
+				}
+
+				users := backupTestUsers(t, store)
+				if len(users) != 2 || users["bob"] == 0 || users["ann"] == 0 {
+					t.Errorf("users are %v", users)
+				}
+
+				checkStrings(t, "sessions", backupTestNotes(t, store, anonymous), "existing first", "second", "existing")
+				checkStrings(t, "sessions of ann", backupTestNotes(t, store, Scope{UserID: users["ann"], Timer: "work"}), "running")
+
+				// everything is a duplicate the second time
+				result, err = store.Restore(b, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if *result != (RestoreResult{Users: 0, Sessions: 0, Skipped: 3}) {
+					t.Errorf("result of repeated merge is %+v", result)
+				}
+			})
+
+			t.Run("replace", func(t *testing.T) {
+				store := existing()
+
+				result, err := store.Restore(b, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if *result != (RestoreResult{Users: 1, Sessions: 3, Skipped: 0}) {
+					t.Errorf("result is %+v", result)
+				}
+
+				users := backupTestUsers(t, store)
+				if len(users) != 1 || users["ann"] != ann.ID {
+					t.Errorf("users are %v", users)
+				}
+
+				checkStrings(t, "sessions", backupTestNotes(t, store, anonymous), "first", "second")
+				checkStrings(t, "sessions of ann", backupTestNotes(t, store, Scope{UserID: ann.ID, Timer: "work"}), "running")
+
+				restored, err := store.Backup()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for i, s := range restored.Sessions {
+					if s.ID != b.Sessions[i].ID {
+						t.Errorf("session %d has ID %d after replace", b.Sessions[i].ID, s.ID)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestReadBackupValidates(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not a backup", `{"format": "other", "version": 1}`},
+		{"newer version", `{"format": "stopwatch-backup", "version": 100}`},
+		{"unknown user", `{"format": "stopwatch-backup", "version": 1, "sessions": [{"user_id": 5, "timer": "default", "id": 1, "start": 1000, "end": 2000}]}`},
+		{"duplicate session", `{"format": "stopwatch-backup", "version": 1, "sessions": [{"timer": "default", "id": 1, "start": 1000, "end": 2000}, {"timer": "default", "id": 1, "start": 3000, "end": 4000}]}`},
+		{"ends before start", `{"format": "stopwatch-backup", "version": 1, "sessions": [{"timer": "default", "id": 1, "start": 2000, "end": 1000}]}`},
+		{"invalid JSON", `{"format": `},
+	}
+
+	for _, test := range tests {
+		_, err := readBackup([]byte(test.data))
+		if err == nil {
+			t.Errorf("%s: backup is accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// number of days in calendar feed by default
+const calendarDays = 90
+
+const icsTimeFormat = "20060102T150405Z"
+
+// CalendarURLAPIResponse is returned by /calendar-url handler
+type CalendarURLAPIResponse struct {
+	URL string `json:"url"`
+}
+
+// calendarKey returns secret key of calendar feed of a stopwatch,
+// it's HMAC of user ID and stopwatch name, so a leaked key gives
+// access to one feed only and all keys are revoked by changing the secret
+func calendarKey(secret string, scope Scope) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d/%s", scope.UserID, scope.Timer)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// calendarURL returns URL of calendar feed of a stopwatch
+// with the key that grants access to it
+func (srv *Server) calendarURL(r *http.Request, sw *Stopwatch) string {
+	scope := sw.store.Scope()
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	params := url.Values{"key": {calendarKey(srv.config.Calendar.Secret, scope)}}
+	if scope.UserID != 0 {
+		params.Set("user", strconv.FormatInt(scope.UserID, 10))
+	}
+
+	return scheme + "://" + r.Host + srv.stopwatchPrefix(sw) + "/calendar.ics?" + params.Encode()
+}
+
+func (srv *Server) handleCalendarURL(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	if srv.config.Calendar.Secret == "" {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "calendar feed is disabled, set calendar.secret in config")
+		return
+	}
+
+	writeJSON(w, CalendarURLAPIResponse{URL: srv.calendarURL(r, sw)})
+}
+
+// handleCalendar serves iCalendar feed of sessions of a stopwatch.
+// Calendar apps can't send credentials, so the feed is not behind
+// HTTP authentication and is accessed with a key given in the URL
+// instead, see calendarKey. Range is set with from and to parameters
+// as in /stat, the last 90 days by default. The running session is
+// added as an event ending now if ongoing parameter is set
+func (srv *Server) handleCalendar(w http.ResponseWriter, r *http.Request, timer string) {
+	secret := srv.config.Calendar.Secret
+	query := r.URL.Query()
+
+	userID := int64(0)
+	if query.Get("user") != "" {
+		var err error
+		userID, err = strconv.ParseInt(query.Get("user"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeBadRequest, "invalid user")
+			return
+		}
+	}
+
+	scope := Scope{UserID: userID, Timer: timer}
+	key := query.Get("key")
+	if secret == "" || !hmac.Equal([]byte(key), []byte(calendarKey(secret, scope))) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "calendar not found")
+		return
+	}
+
+	req, err := parseStatRequest(query, srv.config.Stopwatch, srv.clock.Now(), calendarDays)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+		return
+	}
+
+	sessions, err := srv.store.WithScope(scope).OverlappingSessions(req.From, req.To)
+	if err != nil {
+		writeInternalError(w, "failed to load sessions", err)
+		return
+	}
+
+	ongoing := query.Get("ongoing") != ""
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+
+	cal := &icsWriter{}
+	cal.line("BEGIN", "VCALENDAR")
+	cal.line("VERSION", "2.0")
+	cal.line("PRODID", "-//stopwatch//EN")
+	cal.line("CALSCALE", "GREGORIAN")
+	cal.line("X-WR-CALNAME", icsEscape("Stopwatch: "+timer))
+
+	now := srv.clock.Now()
+	for _, session := range sessions {
+		end := session.End
+		if session.Opened {
+			if !ongoing {
+				continue
+			}
+			end = now
+		}
+
+		summary := session.Project
+		if summary == "" {
+			summary = timer
+		}
+
+		description := session.Note
+		if len(session.Tags) > 0 {
+			if description != "" {
+				description += "\n"
+			}
+			description += "tags: " + strings.Join(session.Tags, ", ")
+		}
+
+		cal.line("BEGIN", "VEVENT")
+		cal.line("UID", fmt.Sprintf("session-%d@stopwatch", session.ID))
+		cal.line("DTSTAMP", now.UTC().Format(icsTimeFormat))
+		cal.line("DTSTART", session.Start.UTC().Format(icsTimeFormat))
+		cal.line("DTEND", end.UTC().Format(icsTimeFormat))
+		cal.line("SUMMARY", icsEscape(summary))
+		if description != "" {
+			cal.line("DESCRIPTION", icsEscape(description))
+		}
+		if session.Opened {
+			cal.line("STATUS", "TENTATIVE")
+		} else {
+			cal.line("STATUS", "CONFIRMED")
+		}
+		cal.line("TRANSP", "OPAQUE")
+		cal.line("END", "VEVENT")
+	}
+
+	cal.line("END", "VCALENDAR")
+
+	_, err = w.Write([]byte(cal.String()))
+	if err != nil {
+		log.Printf("failed to write calendar: %s\n", err)
+	}
+}
+
+// icsWriter builds iCalendar content, lines end with CRLF
+// and are folded at 75 octets as RFC 5545 requires
+type icsWriter struct {
+	strings.Builder
+}
+
+func (c *icsWriter) line(name string, value string) {
+	line := name + ":" + value
+
+	for len(line) > 75 {
+		cut := 75
+		// don't split UTF-8 sequences
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		c.WriteString(line[:cut] + "\r\n")
+		line = " " + line[cut:]
+	}
+
+	c.WriteString(line + "\r\n")
+}
+
+// icsEscape escapes TEXT value of iCalendar property
+func icsEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 )
 
 func countClientFlags() int {
@@ -22,10 +25,31 @@ func countClientFlags() int {
 		cnt++
 	}
 
+	if *undoFlag {
+		cnt++
+	}
+
+	if *redoFlag {
+		cnt++
+	}
+
+	if *statFlag {
+		cnt++
+	}
+
+	if *exportFlag != "" {
+		cnt++
+	}
+
+	if *importFlag != "" {
+		cnt++
+	}
+
 	return cnt
 }
 
-func getURL(cfg *HTTPConfig) string {
+// getURL returns base URL of the API of a named stopwatch
+func getURL(cfg *HTTPConfig, timer string) string {
 	url := "http://localhost"
 	if cfg.Port != 80 {
 		url += fmt.Sprintf(":%d", cfg.Port)
@@ -33,49 +57,148 @@ func getURL(cfg *HTTPConfig) string {
 
 	url += cfg.HrefPrefix
 
+	if timer != defaultTimer {
+		url += "/w/" + timer
+	}
+
 	return url
 }
 
-func sendAPIRequest(url string) (*APIResponse, error) {
-	resp, err := http.Get(url)
+// sendAPIRequest calls API v2 endpoint of a stopwatch that returns its state
+func sendAPIRequest(method string, baseURL string, path string, params url.Values, creds *ClientConfig) (*APIResponse, error) {
+	swData := &APIResponse{}
+	err := doAPIRequest(method, baseURL, path, params, creds, swData)
+	if err != nil {
+		return nil, err
+	}
+
+	return swData, nil
+}
+
+// doAPIRequest calls API v2 endpoint of a stopwatch and parses JSON response into v
+func doAPIRequest(method string, baseURL string, path string, params url.Values, creds *ClientConfig, v interface{}) error {
+	data, err := fetchAPI(method, baseURL, path, params, creds)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("parse response: %s", err)
+	}
+
+	return nil
+}
+
+// fetchAPI calls API v2 endpoint of a stopwatch and returns response body.
+// Parameters are sent in query of GET requests and as form body of POST requests
+func fetchAPI(method string, baseURL string, path string, params url.Values, creds *ClientConfig) ([]byte, error) {
+	endpoint := baseURL + apiV2Prefix + path
+	var body io.Reader
+
+	if method == http.MethodGet {
+		if len(params) > 0 {
+			endpoint += "?" + params.Encode()
+		}
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	return sendRequest(req, creds)
+}
+
+// sendRequest sends API request with credentials and returns response body.
+// Error responses are returned as *APIError
+func sendRequest(req *http.Request, creds *ClientConfig) ([]byte, error) {
+	setAuthHeader(req, creds)
+	resp, err := http.DefaultClient.Do(req)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to stopwatch server: %s", err)
 	}
 
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	data, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil {
 		return nil, fmt.Errorf("read response: %s", err)
 	}
 
-	swData := &APIResponse{}
-	err = json.Unmarshal(body, swData)
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &APIError{}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+		}
 
-	if err != nil {
-		return nil, fmt.Errorf("parse response: %s", err)
+		return nil, apiErr
 	}
 
-	return swData, nil
+	return data, nil
 }
 
-func clientStart(baseURL string) (*APIResponse, error) {
-	swData, err := sendAPIRequest(baseURL + "/start")
-	return swData, err
+// startParams returns parameters of start request with optional project, tags and note
+func startParams(project string, tags string, note string) url.Values {
+	params := url.Values{}
+	if project != "" {
+		params.Set("project", project)
+	}
+	if tags != "" {
+		params.Set("tags", tags)
+	}
+	if note != "" {
+		params.Set("note", note)
+	}
+
+	return params
 }
 
-func runClient(baseURL string) {
-	var path string
+func runClient(baseURL string, creds *ClientConfig) {
+	if *statFlag {
+		runStatClient(baseURL, creds)
+		return
+	}
+
+	if *exportFlag != "" {
+		runExportClient(baseURL, creds)
+		return
+	}
+
+	if *importFlag != "" {
+		runImportClient(baseURL, creds)
+		return
+	}
+
+	method := http.MethodPost
+	path := ""
+	params := url.Values{}
+
 	if *startFlag {
 		path = "/start"
+		params = startParams(*projectFlag, *tagsFlag, *noteFlag)
 	} else if *stopFlag {
 		path = "/stop"
+		if *noteFlag != "" {
+			params.Set("note", *noteFlag)
+		}
+	} else if *undoFlag {
+		path = "/undo"
+	} else if *redoFlag {
+		path = "/redo"
 	} else {
+		method = http.MethodGet
 		path = "/time"
 	}
 
-	resp, err := sendAPIRequest(baseURL + path)
+	resp, err := sendAPIRequest(method, baseURL, path, params, creds)
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "stopwatch request failed: %s\n", err)
@@ -85,6 +208,9 @@ func runClient(baseURL string) {
 	msg := ""
 	if resp.Running {
 		msg += "Running"
+		if resp.Project != "" {
+			msg += " on " + resp.Project
+		}
 	} else {
 		msg += "Stopped"
 	}
@@ -95,3 +221,112 @@ func runClient(baseURL string) {
 
 	fmt.Println(msg)
 }
+
+// runStatClient prints totals of periods and their projects
+func runStatClient(baseURL string, creds *ClientConfig) {
+	params := url.Values{"group": {*groupFlag}}
+	if *fromFlag != "" {
+		params.Set("from", *fromFlag)
+	}
+	if *toFlag != "" {
+		params.Set("to", *toFlag)
+	}
+
+	var periods []PeriodStatAPIResponse
+	err := doAPIRequest(http.MethodGet, baseURL, "/stat", params, creds, &periods)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stopwatch request failed: %s\n", err)
+		return
+	}
+
+	for _, period := range periods {
+		label := period.From
+		if period.To != period.From {
+			label += " - " + period.To
+		}
+
+		fmt.Printf("%-25s %s\n", label, formatElapsedTime(period.Time))
+
+		for _, pt := range projectTotals(period.Projects) {
+			project := pt.Project
+			if project == "" {
+				project = "no project"
+			}
+			fmt.Printf("    %-21s %s\n", project, pt.FormatElapsedTime())
+		}
+	}
+}
+
+// runExportClient prints CSV export of sessions or days
+func runExportClient(baseURL string, creds *ClientConfig) {
+	params := url.Values{"group": {*groupFlag}}
+	if *fromFlag != "" {
+		params.Set("from", *fromFlag)
+	}
+	if *toFlag != "" {
+		params.Set("to", *toFlag)
+	}
+
+	data, err := fetchAPI(http.MethodGet, baseURL, "/export/"+*exportFlag+".csv", params, creds)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stopwatch request failed: %s\n", err)
+		return
+	}
+
+	os.Stdout.Write(data)
+}
+
+// runImportClient sends a file to import and prints the summary,
+// in dry-run mode every row is printed
+func runImportClient(baseURL string, creds *ClientConfig) {
+	file, err := os.Open(*importFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open file: %s\n", err)
+		return
+	}
+	defer file.Close()
+
+	params := url.Values{"format": {*formatFlag}}
+	if *dryRunFlag {
+		params.Set("dry_run", "1")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, baseURL+apiV2Prefix+"/import?"+params.Encode(), file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stopwatch request failed: %s\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	data, err := sendRequest(req, creds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stopwatch request failed: %s\n", err)
+		return
+	}
+
+	result := &ImportResult{}
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse response: %s\n", err)
+		return
+	}
+
+	for _, row := range result.Rows {
+		if row.Session != nil {
+			fmt.Printf("line %d: insert %s - %s %s\n", row.Line,
+				millisToTime(row.Session.Start).Format("2006-01-02 15:04"),
+				millisToTime(row.Session.End).Format("2006-01-02 15:04"),
+				row.Session.Project)
+		} else {
+			fmt.Printf("line %d: skip, %s\n", row.Line, row.Reason)
+		}
+	}
+
+	if result.DryRun {
+		fmt.Printf("dry run: %d sessions would be inserted, %d rows skipped\n", result.Inserted, result.Skipped)
+	} else {
+		fmt.Printf("%d sessions inserted, %d rows skipped\n", result.Inserted, result.Skipped)
+	}
+}
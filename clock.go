@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a source of current time for stopwatches and their workers,
+// so that day rollover can be simulated with FakeClock.
+// Wall time of Now may jump when system clock is changed,
+// Elapsed is monotonic and counts real time passed, like timers of After do
+type Clock interface {
+	Now() time.Time
+	// Elapsed returns monotonic time passed since the clock was created
+	Elapsed() time.Duration
+	// After sends current time to the returned channel once d of monotonic time passes
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the real time clock
+var systemClock Clock = realClock{start: time.Now()}
+
+type realClock struct {
+	start time.Time
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Elapsed uses monotonic reading of start that time.Now returns
+func (c realClock) Elapsed() time.Duration {
+	return time.Since(c.start)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FakeClock is a manually advanced clock. Advance moves both wall and
+// monotonic time and fires channels returned by After when their deadline
+// passes, Set changes wall time only, like a change of system clock
+type FakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	elapsed time.Duration
+	waiters []fakeWaiter
+}
+
+// fakeWaiter deadline is in monotonic time of the clock
+type fakeWaiter struct {
+	deadline time.Duration
+	ch       chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// Elapsed returns the sum of all Advance calls
+func (c *FakeClock) Elapsed() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.elapsed
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, fakeWaiter{deadline: c.elapsed + d, ch: ch})
+	return ch
+}
+
+// Advance moves wall and monotonic time forward by d
+// and fires due waiters in order of deadlines
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	c.elapsed += d
+
+	sort.SliceStable(c.waiters, func(i, j int) bool {
+		return c.waiters[i].deadline < c.waiters[j].deadline
+	})
+
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline > c.elapsed {
+			waiting = append(waiting, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+// Set sets wall time to t without firing waiters,
+// t may be in the past to simulate wall clock jumps
+func (c *FakeClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = t
+}
+
+// Waiters returns the number of pending After calls,
+// it lets callers wait until a worker goes to sleep
+func (c *FakeClock) Waiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.waiters)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -13,6 +14,9 @@ type Config struct {
 	Stopwatch *StopwatchConfig `toml:"stopwatch"`
 	DB        *DBConfig        `toml:"db"`
 	HTTP      *HTTPConfig      `toml:"http"`
+	Client    *ClientConfig    `toml:"client"`
+	Export    *ExportConfig    `toml:"export"`
+	Calendar  *CalendarConfig  `toml:"calendar"`
 }
 
 // StopwatchConfig is part of config related to the app itself
@@ -21,10 +25,103 @@ type StopwatchConfig struct {
 	DayStartHour         int    `toml:"day_start_hour"`
 	Log                  string `toml:"log"`
 	DisplayNotifications bool   `toml:"display_notifications"` // display os x notifcations via osascript
+	JournalSize          int    `toml:"journal_size"`          // number of actions that can be undone, 0 disables journal
+	FirstDayOfWeek       string `toml:"first_day_of_week"`     // start of weeks in statistics grouped by week, e.g. "monday"
+	MaxSessionHours      int    `toml:"max_session_hours"`     // sessions running longer are treated as forgotten, 0 disables the limit
+	LongSessions         string `toml:"long_sessions"`         // what to do with forgotten sessions: "cap" or "discard"
+	Timezone             string `toml:"timezone"`              // IANA time zone of days, e.g. "Europe/Berlin", local zone of server if empty
+	DayStart             string `toml:"day_start"`             // start of days in HH:MM format, overrides day_start_hour
+
+	// starts of days of particular weekdays in HH:MM format, e.g. saturday = "10:00"
+	WeekdayDayStart map[string]string `toml:"weekday_day_start"`
+
+	location *time.Location
+	// minutes from midnight to day start by weekday, set by ParseConfig
+	dayStarts *[7]int
+}
+
+// what is done with sessions running longer than MaxSessionHours
+const (
+	longSessionsCap     = "cap"
+	longSessionsDiscard = "discard"
+)
+
+// Location returns time zone of days set in config
+func (cfg *StopwatchConfig) Location() *time.Location {
+	if cfg.location == nil {
+		return time.Local
+	}
+
+	return cfg.location
+}
+
+// dayStartMinutes returns minutes from midnight to start of days of a weekday
+func (cfg *StopwatchConfig) dayStartMinutes(weekday time.Weekday) int {
+	if cfg.dayStarts == nil {
+		return cfg.DayStartHour * 60
+	}
+
+	return cfg.dayStarts[weekday]
+}
+
+// parseDayStarts parses day_start and weekday_day_start options,
+// day_start_hour is used if day_start is not set
+func (cfg *StopwatchConfig) parseDayStarts() error {
+	if cfg.DayStartHour < 0 || cfg.DayStartHour > 23 {
+		return fmt.Errorf("day_start_hour must be from 0 to 23")
+	}
+
+	start := cfg.DayStartHour * 60
+	if cfg.DayStart != "" {
+		var err error
+		start, err = parseClockTime(cfg.DayStart)
+		if err != nil {
+			return fmt.Errorf("day_start: %s", err)
+		}
+	}
+
+	starts := [7]int{}
+	for i := range starts {
+		starts[i] = start
+	}
+
+	for name, value := range cfg.WeekdayDayStart {
+		day, err := parseWeekday(name)
+		if err != nil {
+			return fmt.Errorf("weekday_day_start: %s", err)
+		}
+
+		starts[day], err = parseClockTime(value)
+		if err != nil {
+			return fmt.Errorf("weekday_day_start.%s: %s", name, err)
+		}
+	}
+
+	cfg.dayStarts = &starts
+	return nil
+}
+
+// MaxSessionLength returns the limit of session length, 0 if it's not set
+func (cfg *StopwatchConfig) MaxSessionLength() time.Duration {
+	return time.Duration(cfg.MaxSessionHours) * time.Hour
+}
+
+// WeekStart returns the first day of week of statistics
+func (cfg *StopwatchConfig) WeekStart() time.Weekday {
+	day, err := parseWeekday(cfg.FirstDayOfWeek)
+	if err != nil {
+		return time.Monday
+	}
+
+	return day
 }
 
-// DBConfig is MySQL configuration
+// DBConfig is storage configuration.
+// Driver is one of "mysql", "sqlite" or "memory".
+// Path is used by sqlite only, the rest of the fields by mysql only
 type DBConfig struct {
+	Driver   string `toml:"driver"`
+	Path     string `toml:"path"`
 	User     string `toml:"user"`
 	Password string `toml:"password"`
 	Host     string `toml:"host"`
@@ -34,9 +131,43 @@ type DBConfig struct {
 
 // HTTPConfig is config of HTTP server
 type HTTPConfig struct {
-	Port       int    `toml:"port"`
-	StaticDir  string `toml:"static_dir"`
-	HrefPrefix string `toml:"href_prefix"` // prefix of stopwatch urls (e.g. if stopwatch is behind a proxy)
+	Port       int         `toml:"port"`
+	StaticDir  string      `toml:"static_dir"`
+	HrefPrefix string      `toml:"href_prefix"` // prefix of stopwatch urls (e.g. if stopwatch is behind a proxy)
+	MultiUser  bool        `toml:"multi_user"`  // every request must have API token of a user, each user has own sessions
+	Auth       *AuthConfig `toml:"auth"`
+
+	// number of stopwatches kept in memory, idle ones are unloaded when it's reached
+	MaxStopwatches int `toml:"max_stopwatches"`
+}
+
+// AuthConfig is config of HTTP authentication, when enabled
+// every request must have credentials of one of the users or one of the tokens.
+// Users maps user names to bcrypt hashes of passwords (see -hash-password flag)
+type AuthConfig struct {
+	Enabled bool              `toml:"enabled"`
+	Users   map[string]string `toml:"users"`
+	Tokens  []string          `toml:"tokens"` // accepted as "Authorization: Bearer <token>" header or token parameter
+}
+
+// ClientConfig holds credentials sent by CLI commands to the server
+// STOPWATCH_TOKEN, STOPWATCH_USER and STOPWATCH_PASSWORD environment variables override them
+type ClientConfig struct {
+	Token    string `toml:"token"`
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+}
+
+// ExportConfig is config of CSV export
+// TimeFormat is "rfc3339" for local time or "millis" for Unix time in milliseconds
+type ExportConfig struct {
+	TimeFormat string `toml:"time_format"`
+}
+
+// CalendarConfig is config of iCalendar feeds
+// Secret is used to sign keys of feed URLs, feeds are disabled if it's empty
+type CalendarConfig struct {
+	Secret string `toml:"secret"`
 }
 
 // NewConfig creates a new Config instance with default values
@@ -46,18 +177,35 @@ func NewConfig() *Config {
 			DayStartHour:         8,
 			Log:                  "/usr/local/stopwatch/error.log",
 			DisplayNotifications: false,
+			JournalSize:          100,
+			FirstDayOfWeek:       "monday",
+			LongSessions:         longSessionsCap,
 		},
 		DB: &DBConfig{
+			Driver:   driverMySQL,
+			Path:     "/usr/local/stopwatch/stopwatch.db",
 			Host:     "127.0.0.1",
 			Port:     3306,
 			User:     "root",
 			Database: "stopwatch",
 		},
 		HTTP: &HTTPConfig{
-			Port:       8080,
-			StaticDir:  "/usr/local/stopwatch/ui",
-			HrefPrefix: "/stopwatch",
+			Port:           8080,
+			StaticDir:      "/usr/local/stopwatch/ui",
+			HrefPrefix:     "/stopwatch",
+			MultiUser:      false,
+			MaxStopwatches: 100,
+			Auth: &AuthConfig{
+				Enabled: false,
+				Users:   map[string]string{},
+				Tokens:  []string{},
+			},
+		},
+		Client: &ClientConfig{},
+		Export: &ExportConfig{
+			TimeFormat: timeFormatRFC3339,
 		},
+		Calendar: &CalendarConfig{},
 	}
 }
 
@@ -76,6 +224,40 @@ func ParseConfig(filePath string) (*Config, error) {
 		return nil, err
 	}
 
+	_, err = parseWeekday(cfg.Stopwatch.FirstDayOfWeek)
+	if err != nil {
+		return nil, fmt.Errorf("first_day_of_week: %s", err)
+	}
+
+	if cfg.Stopwatch.Timezone != "" {
+		cfg.Stopwatch.location, err = time.LoadLocation(cfg.Stopwatch.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %s", err)
+		}
+	}
+
+	err = cfg.Stopwatch.parseDayStarts()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Stopwatch.MaxSessionHours < 0 {
+		return nil, fmt.Errorf("max_session_hours must not be negative")
+	}
+
+	if cfg.HTTP.MaxStopwatches < 1 {
+		return nil, fmt.Errorf("max_stopwatches must be positive")
+	}
+
+	if cfg.Stopwatch.LongSessions != longSessionsCap && cfg.Stopwatch.LongSessions != longSessionsDiscard {
+		return nil, fmt.Errorf("long_sessions must be %s or %s", longSessionsCap, longSessionsDiscard)
+	}
+
+	err = checkTimeFormat(cfg.Export.TimeFormat)
+	if err != nil {
+		return nil, fmt.Errorf("export.time_format: %s", err)
+	}
+
 	return cfg, nil
 }
 
@@ -1,67 +1,75 @@
 package main
 
 import (
-	"database/sql"
 	"fmt"
-	"log"
+	"sort"
+	"strings"
 	"time"
-
-	_ "github.com/go-sql-driver/mysql"
 )
 
-func openDB(cfg *DBConfig) (*sql.DB, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
-	db, err := sql.Open("mysql", dsn)
-	return db, err
-}
-
 // Session represents an interval when stopwatch was running
 // when session is created, Start is set to current time and
 // Opened is true. When it's closed End is set to current time
-// and Opened to false
+// and Opened to false. ID is assigned by the store when
+// session is saved for the first time.
+// Project, Tags and Note are optional, empty project means no project
 type Session struct {
-	Start  time.Time
-	End    time.Time
-	Opened bool
+	ID      int64
+	Start   time.Time
+	End     time.Time
+	Opened  bool
+	Project string
+	Tags    []string
+	Note    string
 }
 
-// NewSession creates and opens a new session
-func NewSession() *Session {
+// NewSession creates a new session opened at start
+func NewSession(start time.Time, project string, tags []string, note string) *Session {
 	return &Session{
-		Start:  time.Now(),
-		Opened: true,
+		Start:   start,
+		Opened:  true,
+		Project: project,
+		Tags:    tags,
+		Note:    note,
 	}
 }
 
-// SaveOpened saves session to db with End = NULL
-func (s *Session) SaveOpened(db *sql.DB) error {
-	startMillis := millis(s.Start)
+// SameProject tells if session has given project and tags
+func (s *Session) SameProject(project string, tags []string) bool {
+	return s.Project == project && joinTags(s.Tags) == joinTags(tags)
+}
 
-	_, err := db.Exec("insert into sessions (start, end) values (?, NULL)", startMillis)
-	if err != nil {
-		return err
+// parseTags splits comma-separated tags, spaces around tags and empty tags are dropped
+func parseTags(tags string) []string {
+	var result []string
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			result = append(result, tag)
+		}
 	}
-
-	return nil
+	return result
 }
 
-// Close changes session state to closed
-func (s *Session) Close() {
-	s.End = time.Now()
-	s.Opened = false
+// joinTags makes a comma-separated string of tags, it's the way tags are stored
+func joinTags(tags []string) string {
+	return strings.Join(tags, ",")
 }
 
-// SaveClosed updates row for the session with end = current time
-func (s *Session) SaveClosed(db *sql.DB) error {
-	startMillis := millis(s.Start)
-	endMillis := millis(s.End)
+// SaveOpened saves session to the store with no end
+func (s *Session) SaveOpened(store Store) error {
+	return store.InsertSession(s)
+}
 
-	_, err := db.Exec("update sessions set end = ? where start = ?", endMillis, startMillis)
-	if err != nil {
-		return err
-	}
+// Close changes session state to closed at end
+func (s *Session) Close(end time.Time) {
+	s.End = end
+	s.Opened = false
+}
 
-	return nil
+// SaveClosed updates the stored session with its end
+func (s *Session) SaveClosed(store Store) error {
+	return store.UpdateSession(s)
 }
 
 // Duration returns session's duration in milliseconds
@@ -74,15 +82,26 @@ func (s *Session) Duration() int64 {
 // it is returned in /sessions handler
 // start and end are Unix timestamps in milliseconds
 type SessionAPIResponse struct {
-	Start int64 `json:"start"`
-	End   int64 `json:"end"`
+	ID      int64    `json:"id"`
+	Start   int64    `json:"start"`
+	End     int64    `json:"end"`
+	Project string   `json:"project"`
+	Tags    []string `json:"tags"`
+	Note    string   `json:"note"`
 }
 
 // ToAPIResponse converts session to an API response
 // opened sessions get end = 0
 func (s *Session) ToAPIResponse() SessionAPIResponse {
 	resp := SessionAPIResponse{}
+	resp.ID = s.ID
 	resp.Start = millis(s.Start)
+	resp.Project = s.Project
+	resp.Tags = s.Tags
+	resp.Note = s.Note
+	if resp.Tags == nil {
+		resp.Tags = []string{}
+	}
 	if s.Opened {
 		resp.End = 0
 	} else {
@@ -91,97 +110,192 @@ func (s *Session) ToAPIResponse() SessionAPIResponse {
 	return resp
 }
 
-func splitLastSession(db *sql.DB, cfg *StopwatchConfig) (*Session, error) {
-	var lastStartSql sql.NullInt64
-	var lastEndSql sql.NullInt64
-	err := db.QueryRow("select start, end from sessions order by start desc limit 1").Scan(&lastStartSql, &lastEndSql)
+// sessionRepair describes how an opened session of previous days
+// was split by days, capped or discarded, see splitLastSession.
+// Origin is start of the first part of the session if it was split before
+type sessionRepair struct {
+	Original  *Session
+	Origin    time.Time
+	Parts     []*Session // saved parts, the last one is opened unless session was capped
+	Capped    bool
+	CappedAt  time.Time
+	Discarded bool
+}
 
-	if !lastStartSql.Valid {
-		return nil, fmt.Errorf("session start is Null")
+func (r *sessionRepair) String() string {
+	start := r.Origin.Format("2006-01-02 15:04")
+
+	switch {
+	case r.Discarded:
+		return fmt.Sprintf("session %d started on %s is longer than max_session_hours, discarded with all its parts", r.Original.ID, start)
+	case r.Capped:
+		end := r.CappedAt.Format("2006-01-02 15:04")
+		return fmt.Sprintf("session %d started on %s is longer than max_session_hours, closed on %s in %d parts", r.Original.ID, start, end, len(r.Parts))
+	default:
+		return fmt.Sprintf("session %d started on %s is split into %d days", r.Original.ID, start, len(r.Parts))
 	}
+}
 
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+// sessionOrigin returns start of the first part of a session split by days
+// and the previous parts, ordered from the latest. Parts are closed sessions
+// of the same project and tags that end exactly where the next part starts
+func sessionOrigin(store Store, session *Session) (time.Time, []*Session, error) {
+	origin := session.Start
+	var parts []*Session
+
+	for {
+		overlapping, err := store.OverlappingSessions(origin.Add(-time.Millisecond), origin)
+		if err != nil {
+			return origin, nil, err
 		}
 
+		var previous *Session
+		for _, other := range overlapping {
+			if !other.Opened && other.End.Equal(origin) && other.SameProject(session.Project, session.Tags) {
+				previous = other
+			}
+		}
+
+		if previous == nil {
+			return origin, parts, nil
+		}
+
+		parts = append(parts, previous)
+		origin = previous.Start
+	}
+}
+
+// splitLastSession repairs the last session if it's opened since a previous day.
+// It's split at every day start it crossed, each part is closed at the end
+// of its day and the part of the day of now stays opened. Sessions longer
+// than the max session length, counted from start of their first part,
+// are closed at the limit or deleted with all their parts
+// depending on config. Returns nil if nothing is changed
+func splitLastSession(store Store, cfg *StopwatchConfig, now time.Time) (*sessionRepair, error) {
+	lastSession, err := store.LastSession()
+	if err != nil {
 		return nil, fmt.Errorf("select last session: %s", err)
 	}
 
-	if !lastEndSql.Valid {
-		lastStart := lastStartSql.Int64
-		autoEnd := dayStart(time.Now(), cfg.DayStartHour)
-		log.Printf("open session started on %d will be ended on %d\n", lastStart, autoEnd)
+	if lastSession == nil || !lastSession.Opened {
+		return nil, nil
+	}
 
-		if lastStart < millis(autoEnd) {
-			lastSession := &Session{
-				Start: millisToTime(lastStart),
-				End:   autoEnd,
-			}
+	maxLength := cfg.MaxSessionLength()
+	origin := lastSession.Start
+	var previousParts []*Session
+	if maxLength > 0 {
+		origin, previousParts, err = sessionOrigin(store, lastSession)
+		if err != nil {
+			return nil, fmt.Errorf("find session origin: %s", err)
+		}
+	}
 
-			err := lastSession.SaveClosed(db)
+	tooLong := maxLength > 0 && now.Sub(origin) >= maxLength
 
-			if err != nil {
-				return nil, err
-			}
+	if !tooLong && !lastSession.Start.Before(dayStart(now, cfg)) {
+		return nil, nil
+	}
 
-			lastSessionPart2 := &Session{
-				Start: autoEnd,
-			}
+	repair := &sessionRepair{Original: snapshot(lastSession), Origin: origin}
 
-			err = lastSessionPart2.SaveOpened(db)
+	end := now
+	if tooLong {
+		end = origin.Add(maxLength)
+		repair.Capped = true
+		repair.CappedAt = end
+	}
 
+	// the opened part is deleted if it starts after the limit,
+	// it happens only if the limit was lowered
+	if tooLong && (cfg.LongSessions == longSessionsDiscard || !end.After(lastSession.Start)) {
+		deleted := []*Session{lastSession}
+		if cfg.LongSessions == longSessionsDiscard {
+			deleted = append(deleted, previousParts...)
+			repair.Discarded = true
+		}
+
+		for _, session := range deleted {
+			err = store.DeleteSession(session.ID)
 			if err != nil {
 				return nil, err
 			}
-
-			return lastSessionPart2, nil
 		}
+
+		return repair, nil
 	}
 
-	return nil, nil
-}
+	// save stores a part, the first part is the original session
+	save := func(part *Session) error {
+		if part == lastSession {
+			return store.UpdateSession(part)
+		}
 
-func getAllSessions(db *sql.DB, cfg *StopwatchConfig, t time.Time) ([]*Session, error) {
-	start := dayStart(t, cfg.DayStartHour)
-	end := dayEnd(t, cfg.DayStartHour)
-	rows, err := db.Query("select start, end from sessions where start >= ? and (end <= ? or end is NULL) order by start", millis(start), millis(end))
-	if err != nil {
-		return nil, err
+		return store.InsertSession(part)
 	}
 
-	defer rows.Close()
+	// a day boundary equal to now is crossed, the opened part starts there,
+	// but a capped session ending at the boundary is not split
+	crossed := func(boundary time.Time) bool {
+		if repair.Capped {
+			return boundary.Before(end)
+		}
+		return !boundary.After(end)
+	}
 
-	var sessions []*Session
-	for rows.Next() {
-		var start int64
-		var end int64
-		rows.Scan(
-			&start,
-			&end, // end can be null!
-		)
+	part := lastSession
+	for boundary := dayEnd(part.Start, cfg); crossed(boundary); boundary = dayEnd(boundary, cfg) {
+		part.End = boundary
+		part.Opened = false
 
-		session := &Session{
-			Start: millisToTime(start),
+		err = save(part)
+		if err != nil {
+			return nil, err
 		}
-
-		if end == 0 {
-			session.Opened = true
-		} else {
-			session.End = millisToTime(end)
+		repair.Parts = append(repair.Parts, part)
+
+		part = &Session{
+			Start:   boundary,
+			Opened:  true,
+			Project: lastSession.Project,
+			Tags:    lastSession.Tags,
+			Note:    lastSession.Note,
 		}
-		sessions = append(sessions, session)
 	}
 
-	return sessions, nil
+	if !repair.Capped && len(repair.Parts) == 0 {
+		// nothing is crossed, the session is left as is
+		return nil, nil
+	}
+
+	if repair.Capped {
+		part.End = end
+		part.Opened = false
+	}
+
+	err = save(part)
+	if err != nil {
+		return nil, err
+	}
+	repair.Parts = append(repair.Parts, part)
+
+	return repair, nil
+}
+
+func getAllSessions(store Store, cfg *StopwatchConfig, t time.Time) ([]*Session, error) {
+	start := dayStart(t, cfg)
+	end := dayEnd(t, cfg)
+	return store.Sessions(start, end)
 }
 
 // DayStat represents a total time stopwatch was running for a specific date
 // StartTime is a start of the date
 // ElapsedTime is duration in milliseconds
+// Projects holds durations in milliseconds per project, sessions without project are under ""
 type DayStat struct {
 	StartTime   time.Time
 	ElapsedTime int64
+	Projects    map[string]int64
 }
 
 // Date returns formatted date for ui
@@ -194,40 +308,86 @@ func (ds DayStat) FormatElapsedTime() string {
 	return formatElapsedTime(ds.ElapsedTime)
 }
 
-// ToAPIResponse converts DatStat instance to API response
-func (ds DayStat) ToAPIResponse() DayStatAPIResponse {
-	return DayStatAPIResponse{
-		Time: ds.ElapsedTime,
-		Date: ds.Date(),
-	}
+// ProjectTotal is a total time of a project for ui
+type ProjectTotal struct {
+	Project     string
+	ElapsedTime int64
+}
+
+// FormatElapsedTime returns formatted time for ui
+func (pt ProjectTotal) FormatElapsedTime() string {
+	return formatElapsedTime(pt.ElapsedTime)
 }
 
-// DayStatAPIResponse is DayStat representation in JSON
-// Date is formatted date
-// Time is duration in milliseconds
-type DayStatAPIResponse struct {
-	Date string `json:"date"`
-	Time int64  `json:"time"`
+// ProjectTotals returns per-project totals ordered by project name
+func (ds DayStat) ProjectTotals() []ProjectTotal {
+	return projectTotals(ds.Projects)
 }
 
-func loadDayStats(db *sql.DB, cfg *StopwatchConfig, from time.Time, to time.Time) ([]DayStat, error) {
+func projectTotals(projects map[string]int64) []ProjectTotal {
+	totals := make([]ProjectTotal, 0, len(projects))
+	for project, elapsed := range projects {
+		totals = append(totals, ProjectTotal{Project: project, ElapsedTime: elapsed})
+	}
+
+	sort.Slice(totals, func(i, j int) bool {
+		return totals[i].Project < totals[j].Project
+	})
+
+	return totals
+}
+
+// loadDayStats returns totals of days between from and to.
+// Sessions of the whole range are loaded with a single query and clipped
+// at day boundaries, so a session crossing the start of a day is counted
+// in both days. Opened sessions are not counted
+func loadDayStats(store Store, cfg *StopwatchConfig, from time.Time, to time.Time) ([]DayStat, error) {
 	var stats []DayStat
+	var ends []time.Time
 
-	for t := from; t.Before(to); t = dayEnd(t, cfg.DayStartHour) {
-		sessions, err := getAllSessions(db, cfg, t)
-		if err != nil {
-			return nil, err
-		}
-		stat := DayStat{
+	for t := from; t.Before(to); t = dayEnd(t, cfg) {
+		stats = append(stats, DayStat{
 			StartTime: t,
+			Projects:  make(map[string]int64),
+		})
+		ends = append(ends, dayEnd(t, cfg))
+	}
+
+	if len(stats) == 0 {
+		return stats, nil
+	}
+	ends[len(ends)-1] = to
+
+	sessions, err := store.OverlappingSessions(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, session := range sessions {
+		if session.Opened {
+			continue
 		}
-		for i := range sessions {
-			if !sessions[i].Opened {
-				stat.ElapsedTime += millis(sessions[i].End) - millis(sessions[i].Start)
+
+		// the first day that ends after session start
+		first := sort.Search(len(ends), func(i int) bool {
+			return ends[i].After(session.Start)
+		})
+
+		for i := first; i < len(stats) && stats[i].StartTime.Before(session.End); i++ {
+			start := session.Start
+			if start.Before(stats[i].StartTime) {
+				start = stats[i].StartTime
 			}
-		}
 
-		stats = append(stats, stat)
+			end := session.End
+			if end.After(ends[i]) {
+				end = ends[i]
+			}
+
+			duration := millis(end) - millis(start)
+			stats[i].ElapsedTime += duration
+			stats[i].Projects[session.Project] += duration
+		}
 	}
 
 	return stats, nil
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// types of stopwatch events, state is sent to a new subscriber
+// and when missed events can't be replayed
+const (
+	eventStarted       = "started"
+	eventStopped       = "stopped"
+	eventDayRolledOver = "day_rolled_over"
+	eventSessionEdited = "session_edited"
+	eventState         = "state"
+)
+
+// number of latest events of every stopwatch kept for resume
+const eventHistorySize = 64
+
+// interval of SSE comments that keep idle connections open through proxies
+const sseKeepAlive = 30 * time.Second
+
+// Event is a change of stopwatch state sent to subscribers.
+// Data is the state after the change, the same as /time returns.
+// IDs grow within a server process, so a subscriber can resume
+// from the last received event with Last-Event-ID
+type Event struct {
+	ID   int64        `json:"id"`
+	Type string       `json:"type"`
+	Data *APIResponse `json:"data"`
+
+	stopwatch *Stopwatch
+}
+
+// newEvent makes an event of the current state of stopwatch,
+// its ID is assigned by Hub. sw.lock must be held by caller
+func newEvent(sw *Stopwatch, eventType string) *Event {
+	return &Event{
+		Type:      eventType,
+		Data:      sw.GetAPIResponse(),
+		stopwatch: sw,
+	}
+}
+
+// eventHistory is a list of latest events of a stopwatch,
+// evicted is the ID of the latest event dropped from the list
+type eventHistory struct {
+	events  []*Event
+	evicted int64
+}
+
+func (h *eventHistory) add(ev *Event) {
+	if len(h.events) == eventHistorySize {
+		h.evicted = h.events[0].ID
+		h.events = h.events[1:]
+	}
+
+	h.events = append(h.events, ev)
+}
+
+// since returns events after lastID, false is returned
+// if some of them were evicted or lastID is not of this history.
+// firstID and lastAssigned are the range of IDs issued by the hub
+func (h *eventHistory) since(lastID int64, firstID int64, lastAssigned int64) ([]*Event, bool) {
+	if lastID < firstID-1 || lastID > lastAssigned || lastID < h.evicted {
+		return nil, false
+	}
+
+	for i, ev := range h.events {
+		if ev.ID > lastID {
+			return h.events[i:], true
+		}
+	}
+
+	return nil, true
+}
+
+// lastEventID returns ID of the last event received by a reconnecting client,
+// EventSource sends it in Last-Event-ID header, websocket clients
+// pass it as last_event_id parameter. Returns -1 if it's not set
+func lastEventID(r *http.Request) int64 {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return -1
+	}
+
+	return id
+}
+
+// handleEvents serves Server-Sent Events stream of a stopwatch.
+// The current state is sent first unless the client resumes
+// after an event that is still in history
+func (srv *Server) handleEvents(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "streaming is not supported")
+		return
+	}
+
+	sub := srv.hub.Subscribe(sw, lastEventID(r))
+	defer srv.hub.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disable response buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-sub.Ready():
+			for _, ev := range sub.Take() {
+				err := writeSSE(w, ev)
+				if err != nil {
+					log.Printf("failed to write event: %s\n", err)
+					return
+				}
+			}
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, ev *Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+	return err
+}
+
+// timeouts of websocket connections: pings are sent every wsPingPeriod
+// and a connection is closed if nothing is read from it during wsPongWait
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// handleUpdates sends events of stopwatch over websocket as JSON messages,
+// legacy clients of unversioned /updates get "update" messages without data.
+// Clients must answer pings, dead connections are closed after wsPongWait
+func (srv *Server) handleUpdates(w http.ResponseWriter, r *http.Request, sw *Stopwatch, jsonEvents bool) {
+	conn, err := srv.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("failed to upgrade connection: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	lastID := lastEventID(r)
+	if !jsonEvents {
+		// legacy clients request state on every message
+		lastID = -1
+	}
+
+	sub := srv.hub.Subscribe(sw, lastID)
+	defer srv.hub.Unsubscribe(sub)
+
+	// read pump handles pongs and close messages,
+	// closed is closed when connection fails or is closed by client
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	initial := true
+
+	for {
+		select {
+		case <-sub.Ready():
+			err = writeWebsocketEvents(conn, sub.Take(), jsonEvents, initial)
+			initial = false
+			if err != nil {
+				log.Printf("failed to write message: %s", err)
+				return
+			}
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			if err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// writeWebsocketEvents writes events as JSON messages, legacy clients
+// get one "update" message for all of them. The initial state
+// is not sent to legacy clients as they request state on connect
+func writeWebsocketEvents(conn *websocket.Conn, events []*Event, jsonEvents bool, initial bool) error {
+	if !jsonEvents {
+		if initial && len(events) > 0 && events[0].Type == eventState {
+			events = events[1:]
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteMessage(websocket.TextMessage, []byte("update"))
+	}
+
+	for _, ev := range events {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		err := conn.WriteJSON(ev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
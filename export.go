@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formats of timestamps in exported files
+const (
+	timeFormatRFC3339 = "rfc3339"
+	timeFormatMillis  = "millis"
+)
+
+func checkTimeFormat(format string) error {
+	if format != timeFormatRFC3339 && format != timeFormatMillis {
+		return fmt.Errorf("invalid time format %s, must be %s or %s", format, timeFormatRFC3339, timeFormatMillis)
+	}
+
+	return nil
+}
+
+// formatTimestamp formats time as RFC 3339 in its time zone or as Unix time in milliseconds
+func formatTimestamp(t time.Time, format string) string {
+	if format == timeFormatMillis {
+		return strconv.FormatInt(millis(t), 10)
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// handleExport serves /export/sessions.csv and /export/days.csv,
+// range is set with from, to and group parameters as in /stat
+// and time format can be overridden with time_format parameter
+func (srv *Server) handleExport(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	query := r.URL.Query()
+	req, err := parseStatRequest(query, sw.config, sw.clock.Now(), defaultStatDays)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+		return
+	}
+
+	format := srv.config.Export.TimeFormat
+	if query.Get("time_format") != "" {
+		format = query.Get("time_format")
+	}
+
+	err = checkTimeFormat(format)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+		return
+	}
+
+	var rows [][]string
+	name := strings.TrimPrefix(r.URL.Path, "/export/")
+
+	switch name {
+	case "sessions.csv":
+		rows, err = exportSessions(sw.store, sw.config, req, format)
+	case "days.csv":
+		rows, err = exportDays(sw.store, sw.config, req)
+	default:
+		writeError(w, http.StatusNotFound, errCodeNotFound, "unknown export "+name)
+		return
+	}
+
+	if err != nil {
+		writeInternalError(w, "failed to export "+name, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+
+	writer := csv.NewWriter(w)
+	err = writer.WriteAll(rows)
+	if err != nil {
+		log.Printf("failed to write %s: %s\n", name, err)
+	}
+}
+
+// exportSessions returns CSV rows of closed sessions started in requested range.
+// Day is the date of the day session belongs to with respect to day start
+func exportSessions(store Store, cfg *StopwatchConfig, req *statRequest, format string) ([][]string, error) {
+	sessions, err := store.OverlappingSessions(req.From, req.To)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := [][]string{
+		{"id", "day", "start", "end", "duration_ms", "duration", "project", "tags", "note"},
+	}
+
+	for _, session := range sessions {
+		if session.Opened || session.Start.Before(req.From) {
+			continue
+		}
+
+		rows = append(rows, []string{
+			strconv.FormatInt(session.ID, 10),
+			apiDateFormat(dayStart(session.Start, cfg)),
+			formatTimestamp(session.Start.In(cfg.Location()), format),
+			formatTimestamp(session.End.In(cfg.Location()), format),
+			strconv.FormatInt(session.Duration(), 10),
+			formatElapsedTime(session.Duration()),
+			session.Project,
+			joinTags(session.Tags),
+			session.Note,
+		})
+	}
+
+	return rows, nil
+}
+
+// exportDays returns CSV rows of period totals per project,
+// periods without tracked time have a single row with empty project
+func exportDays(store Store, cfg *StopwatchConfig, req *statRequest) ([][]string, error) {
+	periods, err := loadPeriodStats(store, cfg, req)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := [][]string{
+		{"from", "to", "project", "duration_ms", "duration"},
+	}
+
+	for _, period := range periods {
+		totals := period.ProjectTotals()
+		if len(totals) == 0 {
+			totals = []ProjectTotal{{}}
+		}
+
+		for _, pt := range totals {
+			rows = append(rows, []string{
+				period.FromDate(),
+				period.ToDate(),
+				pt.Project,
+				strconv.FormatInt(pt.ElapsedTime, 10),
+				pt.FormatElapsedTime(),
+			})
+		}
+	}
+
+	return rows, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// maximum number of undelivered events of a subscriber,
+// when it's exceeded the queue is replaced with the current state
+const subscriberQueueSize = 32
+
+// Hub delivers events of stopwatches to subscribers.
+// Publish never blocks: every subscriber has its own queue
+// that is drained by the connection handler at its own pace.
+// Hub also keeps history of events for resuming subscribers
+type Hub struct {
+	lock        sync.Mutex
+	firstID     int64
+	nextID      int64
+	histories   map[*Stopwatch]*eventHistory
+	subscribers map[*Stopwatch]map[*Subscriber]bool
+}
+
+// Subscriber is a queue of events of one stopwatch for one connection.
+// Ready receives a value when the queue becomes non-empty
+type Subscriber struct {
+	stopwatch *Stopwatch
+	ready     chan struct{}
+
+	lock  sync.Mutex
+	queue []*Event
+	// true if the queue was replaced with state since last Take
+	overflowed bool
+}
+
+func NewHub() *Hub {
+	// IDs start from current time, so that IDs of
+	// previous server process are not taken for recent ones
+	firstID := millis(time.Now())
+
+	return &Hub{
+		firstID:     firstID,
+		nextID:      firstID,
+		histories:   make(map[*Stopwatch]*eventHistory),
+		subscribers: make(map[*Stopwatch]map[*Subscriber]bool),
+	}
+}
+
+// Publish makes an event of the current state of stopwatch, assigns an ID
+// to it, adds it to history of the stopwatch and queues it to all subscribers
+// of the stopwatch. The ID is assigned under the stopwatch lock together with
+// the state, so a later event never carries an older state
+func (h *Hub) Publish(sw *Stopwatch, eventType string) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	ev := newEvent(sw, eventType)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ev.ID = h.nextID
+	h.nextID++
+	h.history(sw).add(ev)
+
+	for sub := range h.subscribers[sw] {
+		sub.push(ev)
+	}
+}
+
+// Subscribe registers a subscriber of stopwatch events. lastID is the ID
+// of the last event received before reconnect or -1 for a new subscriber.
+// Missed events are queued if they are still in history, the current state otherwise.
+// The stopwatch lock is taken before the hub lock, like in Publish, so publishing
+// to other stopwatches doesn't wait for this one while it runs store queries
+func (h *Hub) Subscribe(sw *Stopwatch, lastID int64) *Subscriber {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	state := newEvent(sw, eventState)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// no event of the stopwatch is published while its lock is held,
+	// so the state is the one of the latest event
+	state.ID = h.nextID - 1
+
+	sub := &Subscriber{
+		stopwatch: sw,
+		ready:     make(chan struct{}, 1),
+	}
+
+	subs, ok := h.subscribers[sw]
+	if !ok {
+		subs = make(map[*Subscriber]bool)
+		h.subscribers[sw] = subs
+	}
+	subs[sub] = true
+
+	missed, ok := []*Event(nil), false
+	if lastID >= 0 {
+		missed, ok = h.history(sw).since(lastID, h.firstID, h.nextID-1)
+	}
+
+	if !ok {
+		missed = []*Event{state}
+	}
+
+	for _, ev := range missed {
+		sub.push(ev)
+	}
+
+	return sub
+}
+
+func (h *Hub) Unsubscribe(sub *Subscriber) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.subscribers[sub.stopwatch], sub)
+}
+
+// Subscribed returns true if stopwatch has subscribers
+func (h *Hub) Subscribed(sw *Stopwatch) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.subscribers[sw]) > 0
+}
+
+// Remove drops history and subscribers of an unloaded stopwatch
+func (h *Hub) Remove(sw *Stopwatch) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.histories, sw)
+	delete(h.subscribers, sw)
+}
+
+// history returns history of stopwatch events, h.lock must be held by caller
+func (h *Hub) history(sw *Stopwatch) *eventHistory {
+	history, ok := h.histories[sw]
+	if !ok {
+		history = &eventHistory{}
+		h.histories[sw] = history
+	}
+
+	return history
+}
+
+// push queues an event without blocking. All events carry the full state,
+// so an undelivered event of the same type is replaced by the new one.
+// If the subscriber falls behind, its queue is replaced with
+// a single state event, so it never grows beyond subscriberQueueSize
+func (sub *Subscriber) push(ev *Event) {
+	sub.lock.Lock()
+
+	last := len(sub.queue) - 1
+	if last >= 0 && sub.queue[last].Type == ev.Type {
+		sub.queue[last] = ev
+	} else {
+		sub.queue = append(sub.queue, ev)
+	}
+
+	if len(sub.queue) > subscriberQueueSize {
+		if !sub.overflowed {
+			log.Printf("[events] slow subscriber of stopwatch %s, queued events are replaced with state\n", sub.stopwatch.Name)
+		}
+
+		state := *ev
+		state.Type = eventState
+		sub.queue = []*Event{&state}
+		sub.overflowed = true
+	}
+
+	sub.lock.Unlock()
+
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready returns a channel that receives a value when there are queued events
+func (sub *Subscriber) Ready() <-chan struct{} {
+	return sub.ready
+}
+
+// Take returns and removes all queued events
+func (sub *Subscriber) Take() []*Event {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	events := sub.queue
+	sub.queue = nil
+	sub.overflowed = false
+
+	return events
+}
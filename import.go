@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formats of imported files
+const (
+	importAuto        = "auto"
+	importCSV         = "csv"
+	importToggl       = "toggl"
+	importTimewarrior = "timewarrior"
+)
+
+// maximum size of imported file
+const maxImportSize = 32 << 20
+
+// statuses of imported rows
+const (
+	importInserted = "inserted"
+	importSkipped  = "skipped"
+)
+
+// importRow is a session parsed from a line of imported file,
+// err is set if the line can't be parsed
+type importRow struct {
+	line    int
+	session *Session
+	err     error
+}
+
+// ImportResult is a summary of import, Rows has all rows in dry-run mode
+// and only skipped rows otherwise
+type ImportResult struct {
+	DryRun   bool              `json:"dry_run"`
+	Inserted int               `json:"inserted"`
+	Skipped  int               `json:"skipped"`
+	Rows     []ImportRowResult `json:"rows"`
+}
+
+// ImportRowResult is a result of import of one row,
+// Session is set for inserted rows, Reason for skipped ones
+type ImportRowResult struct {
+	Line    int                 `json:"line"`
+	Status  string              `json:"status"`
+	Reason  string              `json:"reason,omitempty"`
+	Session *SessionAPIResponse `json:"session,omitempty"`
+}
+
+// parseImport parses sessions from imported file, format is detected
+// by content if it's auto or empty. Times without zone are in location loc
+func parseImport(data []byte, format string, loc *time.Location) ([]importRow, error) {
+	if format == "" || format == importAuto {
+		format = detectImportFormat(data)
+	}
+
+	switch format {
+	case importCSV:
+		return parseCSVImport(data, loc)
+	case importToggl:
+		return parseTogglImport(data, loc)
+	case importTimewarrior:
+		return parseTimewarriorImport(data)
+	}
+
+	return nil, fmt.Errorf("unknown format %s, must be one of auto, csv, toggl, timewarrior", format)
+}
+
+func detectImportFormat(data []byte) string {
+	firstLine := string(data)
+	if i := strings.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+
+	if strings.HasPrefix(firstLine, "inc ") {
+		return importTimewarrior
+	}
+
+	if strings.Contains(firstLine, "Start date") && strings.Contains(firstLine, "Start time") {
+		return importToggl
+	}
+
+	return importCSV
+}
+
+// readCSV returns records of CSV file with their line numbers,
+// header is returned separately if first record has a "start" column
+func readCSV(data []byte) (header map[string]int, records [][]string, lines []int, err error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if len(records) == 0 && header == nil && isCSVHeader(record) {
+			header = make(map[string]int)
+			for i, name := range record {
+				header[strings.ToLower(strings.TrimSpace(name))] = i
+			}
+			continue
+		}
+
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+
+	return header, records, lines, nil
+}
+
+func isCSVHeader(record []string) bool {
+	for _, name := range record {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "start" || name == "start date" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseCSVImport parses generic CSV with start, end, project and note columns.
+// Columns are taken by names of header if there is one (so that files of
+// /export/sessions.csv can be imported) or by position otherwise
+func parseCSVImport(data []byte, loc *time.Location) ([]importRow, error) {
+	header, records, lines, err := readCSV(data)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{"start": 0, "end": 1, "project": 2, "note": 3, "tags": -1}
+	if header != nil {
+		for name := range columns {
+			columns[name] = -1
+			if i, ok := header[name]; ok {
+				columns[name] = i
+			}
+		}
+
+		if columns["start"] < 0 || columns["end"] < 0 {
+			return nil, fmt.Errorf("CSV header must have start and end columns")
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i := columns[name]
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	rows := make([]importRow, 0, len(records))
+	for i, record := range records {
+		row := importRow{line: lines[i]}
+
+		start, err := parseImportTime(field(record, "start"), loc)
+		if err != nil {
+			row.err = fmt.Errorf("invalid start: %s", err)
+			rows = append(rows, row)
+			continue
+		}
+
+		end, err := parseImportTime(field(record, "end"), loc)
+		if err != nil {
+			row.err = fmt.Errorf("invalid end: %s", err)
+			rows = append(rows, row)
+			continue
+		}
+
+		row.session = &Session{
+			Start:   start,
+			End:     end,
+			Project: field(record, "project"),
+			Tags:    parseTags(field(record, "tags")),
+			Note:    field(record, "note"),
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// parseTogglImport parses detailed report CSV exported from Toggl,
+// times are in location loc
+func parseTogglImport(data []byte, loc *time.Location) ([]importRow, error) {
+	header, records, lines, err := readCSV(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"start date", "start time", "end date", "end time"} {
+		if _, ok := header[name]; !ok {
+			return nil, fmt.Errorf("Toggl CSV must have %s column", name)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := header[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	rows := make([]importRow, 0, len(records))
+	for i, record := range records {
+		row := importRow{line: lines[i]}
+
+		start, err := time.ParseInLocation("2006-01-02 15:04:05", field(record, "start date")+" "+field(record, "start time"), loc)
+		if err != nil {
+			row.err = fmt.Errorf("invalid start: %s", err)
+			rows = append(rows, row)
+			continue
+		}
+
+		end, err := time.ParseInLocation("2006-01-02 15:04:05", field(record, "end date")+" "+field(record, "end time"), loc)
+		if err != nil {
+			row.err = fmt.Errorf("invalid end: %s", err)
+			rows = append(rows, row)
+			continue
+		}
+
+		row.session = &Session{
+			Start:   start,
+			End:     end,
+			Project: field(record, "project"),
+			Tags:    parseTags(field(record, "tags")),
+			Note:    field(record, "description"),
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// parseTimewarriorImport parses Timewarrior data file (e.g. 2024-01.data).
+// Timewarrior has tags only, the first tag becomes project and the rest are tags,
+// annotation becomes note. Opened intervals are skipped
+func parseTimewarriorImport(data []byte) ([]importRow, error) {
+	var rows []importRow
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		row := importRow{line: lineNum}
+		rows = append(rows, row)
+		last := &rows[len(rows)-1]
+
+		if !strings.HasPrefix(line, "inc ") {
+			last.err = fmt.Errorf("not an interval")
+			continue
+		}
+
+		interval, meta := strings.TrimPrefix(line, "inc "), ""
+		if i := strings.Index(interval, " # "); i >= 0 {
+			interval, meta = interval[:i], interval[i+3:]
+		}
+
+		bounds := strings.Split(interval, " - ")
+		if len(bounds) != 2 {
+			last.err = fmt.Errorf("interval is not closed")
+			continue
+		}
+
+		start, err := time.Parse("20060102T150405Z", strings.TrimSpace(bounds[0]))
+		if err != nil {
+			last.err = fmt.Errorf("invalid start: %s", err)
+			continue
+		}
+
+		end, err := time.Parse("20060102T150405Z", strings.TrimSpace(bounds[1]))
+		if err != nil {
+			last.err = fmt.Errorf("invalid end: %s", err)
+			continue
+		}
+
+		// annotation follows the second # in newer Timewarrior versions
+		annotation := ""
+		if i := strings.Index(meta, " # "); i >= 0 {
+			meta, annotation = meta[:i], meta[i+3:]
+		}
+
+		session := &Session{
+			Start: start.Local(),
+			End:   end.Local(),
+			Note:  unquoteTimewarrior(strings.TrimSpace(annotation)),
+		}
+
+		tags := splitTimewarriorTags(meta)
+		if len(tags) > 0 {
+			session.Project = tags[0]
+			session.Tags = tags[1:]
+		}
+
+		last.session = session
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// splitTimewarriorTags splits space-separated tags, tags with spaces are quoted
+func splitTimewarriorTags(s string) []string {
+	var tags []string
+	var tag strings.Builder
+	quoted, escaped := false, false
+
+	for _, c := range s {
+		switch {
+		case escaped:
+			tag.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			if tag.Len() > 0 {
+				tags = append(tags, tag.String())
+				tag.Reset()
+			}
+		default:
+			tag.WriteRune(c)
+		}
+	}
+
+	if tag.Len() > 0 {
+		tags = append(tags, tag.String())
+	}
+
+	return tags
+}
+
+func unquoteTimewarrior(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+
+	return strings.Replace(s, `\"`, `"`, -1)
+}
+
+// parseImportTime parses Unix time in milliseconds, RFC 3339 time
+// or time in "YYYY-MM-DD HH:MM[:SS]" format in location loc
+func parseImportTime(s string, loc *time.Location) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return millisToTime(ms), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unknown time format %q", s)
+}
+
+// Import inserts parsed sessions that are valid and don't overlap with
+// existing sessions or with each other. In dry-run mode nothing is saved.
+// Inserted sessions are saved to the journal as one action, so an import
+// can be undone. If the action can't be saved, inserted sessions are deleted
+func (s *Stopwatch) Import(rows []importRow, dryRun bool) (*ImportResult, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := &ImportResult{DryRun: dryRun, Rows: []ImportRowResult{}}
+	var accepted []*Session
+	var changes []SessionChange
+
+	for _, row := range rows {
+		reason := ""
+		if row.err != nil {
+			reason = row.err.Error()
+		} else {
+			err := s.validateSession(row.session)
+			if _, ok := err.(*SessionValidationError); ok {
+				reason = err.Error()
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		if reason == "" {
+			for _, other := range accepted {
+				if row.session.Start.Before(other.End) && other.Start.Before(row.session.End) {
+					reason = "session overlaps with another imported session"
+					break
+				}
+			}
+		}
+
+		if reason != "" {
+			result.Skipped++
+			result.Rows = append(result.Rows, ImportRowResult{Line: row.line, Status: importSkipped, Reason: reason})
+			continue
+		}
+
+		if !dryRun {
+			err := s.store.InsertSession(row.session)
+			if err != nil {
+				s.deleteImported(changes)
+				return nil, err
+			}
+			changes = append(changes, SessionChange{After: snapshot(row.session)})
+		}
+
+		accepted = append(accepted, row.session)
+		result.Inserted++
+		if dryRun {
+			resp := row.session.ToAPIResponse()
+			result.Rows = append(result.Rows, ImportRowResult{Line: row.line, Status: importInserted, Session: &resp})
+		}
+	}
+
+	if len(changes) == 0 {
+		return result, nil
+	}
+
+	err := s.saveAction(actionImport, changes)
+	if err != nil {
+		s.deleteImported(changes)
+		return nil, fmt.Errorf("import is rolled back: %s", err)
+	}
+
+	return result, s.LoadSessions()
+}
+
+// deleteImported rolls back a failed import by deleting inserted sessions,
+// an import that can't be undone must not be left half done.
+// s.lock must be held by caller
+func (s *Stopwatch) deleteImported(changes []SessionChange) {
+	for _, change := range changes {
+		err := s.store.DeleteSession(change.After.ID)
+		if err != nil {
+			log.Printf("[import] failed to delete imported session %d: %s\n", change.After.ID, err)
+		}
+	}
+}
+
+// handleImport serves POST /import requests, body is the imported file.
+// Format is set with format parameter (auto by default),
+// with dry_run parameter nothing is saved
+func (srv *Server) handleImport(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "failed to read file: "+err.Error())
+		return
+	}
+
+	rows, err := parseImport(data, r.URL.Query().Get("format"), sw.config.Location())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") != ""
+	result, err := sw.Import(rows, dryRun)
+	if err != nil {
+		writeInternalError(w, "failed to import sessions", err)
+		return
+	}
+
+	writeJSON(w, result)
+	if !dryRun && result.Inserted > 0 {
+		srv.updated(sw, eventSessionEdited)
+	}
+}
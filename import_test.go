@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// importTestRow is an expected row of imported file,
+// times are RFC 3339 or local times in "YYYY-MM-DD HH:MM" format
+type importTestRow struct {
+	line    int
+	start   string
+	end     string
+	project string
+	tags    string
+	note    string
+	err     string // part of error message, the row has no session if set
+}
+
+type importTest struct {
+	name string
+	data string
+	rows []importTestRow
+}
+
+func runImportTests(t *testing.T, format string, tests []importTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if detected := detectImportFormat([]byte(test.data)); detected != format {
+				t.Errorf("format is detected as %s", detected)
+			}
+
+			rows, err := parseImport([]byte(test.data), format, time.Local)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkImportRows(t, rows, test.rows)
+		})
+	}
+}
+
+func checkImportRows(t *testing.T, rows []importRow, expected []importTestRow) {
+	t.Helper()
+
+	if len(rows) != len(expected) {
+		t.Fatalf("%d rows, expected %d", len(rows), len(expected))
+	}
+
+	for i, row := range rows {
+		exp := expected[i]
+		if row.line != exp.line {
+			t.Errorf("row %d is on line %d, expected %d", i, row.line, exp.line)
+		}
+
+		if exp.err != "" {
+			if row.err == nil || !strings.Contains(row.err.Error(), exp.err) {
+				t.Errorf("line %d: error %v, expected %q", row.line, row.err, exp.err)
+			}
+			continue
+		}
+
+		if row.err != nil {
+			t.Errorf("line %d: %s", row.line, row.err)
+			continue
+		}
+
+		s := row.session
+		if !s.Start.Equal(importTestTime(t, exp.start)) || !s.End.Equal(importTestTime(t, exp.end)) {
+			t.Errorf("line %d: session is %s - %s, expected %s - %s", row.line, s.Start, s.End, exp.start, exp.end)
+		}
+
+		if s.Project != exp.project || joinTags(s.Tags) != exp.tags || s.Note != exp.note {
+			t.Errorf("line %d: project %q, tags %q, note %q, expected %q, %q, %q", row.line, s.Project, joinTags(s.Tags), s.Note, exp.project, exp.tags, exp.note)
+		}
+	}
+}
+
+func importTestTime(t *testing.T, s string) time.Time {
+	tm, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return tm
+	}
+
+	tm, err = time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tm
+}
+
+func TestParseCSVImport(t *testing.T) {
+	runImportTests(t, importCSV, []importTest{
+		{
+			name: "quoted fields",
+			data: "start,end,project,note\n" +
+				`2024-05-06T09:00:00Z,2024-05-06T10:00:00Z,"work, client","review of ""final"" draft"` + "\n" +
+				`2024-05-06T11:00:00Z,2024-05-06T12:00:00Z,work,"call, then ""notes"""` + "\n",
+			rows: []importTestRow{
+				{line: 2, start: "2024-05-06T09:00:00Z", end: "2024-05-06T10:00:00Z", project: "work, client", note: `review of "final" draft`},
+				{line: 3, start: "2024-05-06T11:00:00Z", end: "2024-05-06T12:00:00Z", project: "work", note: `call, then "notes"`},
+			},
+		},
+		{
+			name: "multiline note",
+			data: "1714986000000,1714989600000,work,\"first line\nsecond line\"\n" +
+				"1714993200000,1714996800000,home\n",
+			rows: []importTestRow{
+				{line: 1, start: "2024-05-06T09:00:00Z", end: "2024-05-06T10:00:00Z", project: "work", note: "first line\nsecond line"},
+				{line: 3, start: "2024-05-06T11:00:00Z", end: "2024-05-06T12:00:00Z", project: "home"},
+			},
+		},
+		{
+			name: "columns by header",
+			data: "\xef\xbb\xbfNote, Tags, End, Start, Project\n" +
+				`"a, b","x, y",2024-05-06 10:00,2024-05-06 09:00,work` + "\n",
+			rows: []importTestRow{
+				{line: 2, start: "2024-05-06 09:00", end: "2024-05-06 10:00", project: "work", tags: "x,y", note: "a, b"},
+			},
+		},
+		{
+			name: "invalid rows",
+			data: "start,end\n" +
+				"yesterday,2024-05-06T10:00:00Z\n" +
+				"2024-05-06T09:00:00Z,\n" +
+				"2024-05-06T11:00:00Z,2024-05-06T12:00:00Z\n",
+			rows: []importTestRow{
+				{line: 2, err: "invalid start"},
+				{line: 3, err: "invalid end"},
+				{line: 4, start: "2024-05-06T11:00:00Z", end: "2024-05-06T12:00:00Z"},
+			},
+		},
+	})
+}
+
+func TestParseTogglImport(t *testing.T) {
+	header := "User,Email,Client,Project,Task,Description,Billable,Start date,Start time,End date,End time,Duration,Tags,Amount ()\n"
+
+	runImportTests(t, importToggl, []importTest{
+		{
+			name: "duration columns",
+			data: header +
+				`Ann,ann@example.com,,Website,,"Fix menu, header",No,2024-05-06,09:00:00,2024-05-06,10:30:00,01:30:00,"design, ui",` + "\n" +
+				`Ann,ann@example.com,,Website,,Deploy,No,2024-05-06,23:30:00,2024-05-07,00:15:00,00:45:00,,` + "\n",
+			rows: []importTestRow{
+				{line: 2, start: "2024-05-06 09:00", end: "2024-05-06 10:30", project: "Website", tags: "design,ui", note: "Fix menu, header"},
+				{line: 3, start: "2024-05-06 23:30", end: "2024-05-07 00:15", project: "Website", note: "Deploy"},
+			},
+		},
+		{
+			name: "invalid time",
+			data: header + "Ann,ann@example.com,,Website,,Deploy,No,2024-05-06,,2024-05-06,10:00:00,01:00:00,,\n",
+			rows: []importTestRow{
+				{line: 2, err: "invalid start"},
+			},
+		},
+	})
+
+	_, err := parseImport([]byte("Project,Description,Start date,Start time,Duration\n"), importToggl, time.Local)
+	if err == nil {
+		t.Error("Toggl CSV without end columns is parsed")
+	}
+}
+
+func TestParseTimewarriorImport(t *testing.T) {
+	runImportTests(t, importTimewarrior, []importTest{
+		{
+			name: "intervals",
+			data: `inc 20240506T090000Z - 20240506T100000Z # work "code review" # "notes with \"quotes\""` + "\n" +
+				"\n" +
+				"inc 20240506T110000Z - 20240506T120000Z\n" +
+				"inc 20240506T130000Z - 20240506T140000Z # home\n",
+			rows: []importTestRow{
+				{line: 1, start: "2024-05-06T09:00:00Z", end: "2024-05-06T10:00:00Z", project: "work", tags: "code review", note: `notes with "quotes"`},
+				{line: 3, start: "2024-05-06T11:00:00Z", end: "2024-05-06T12:00:00Z"},
+				{line: 4, start: "2024-05-06T13:00:00Z", end: "2024-05-06T14:00:00Z", project: "home"},
+			},
+		},
+		{
+			name: "open interval",
+			data: "inc 20240506T090000Z - 20240506T100000Z # work\n" +
+				"inc 20240506T110000Z # work\n" +
+				"version 1.4\n",
+			rows: []importTestRow{
+				{line: 1, start: "2024-05-06T09:00:00Z", end: "2024-05-06T10:00:00Z", project: "work"},
+				{line: 2, err: "not closed"},
+				{line: 3, err: "not an interval"},
+			},
+		},
+	})
+}
+
+// journalFailingStore fails to save journal actions
+type journalFailingStore struct {
+	Store
+}
+
+func (journalFailingStore) InsertAction(a *Action) error {
+	return errors.New("data too long for column changes")
+}
+
+func TestImportIsRolledBackWithoutJournal(t *testing.T) {
+	clock := NewFakeClock(at(0, 12, 0))
+	cfg := NewConfig()
+	cfg.Stopwatch.location = time.UTC
+
+	store := journalFailingStore{newMemoryStore()}
+	sw, err := NewStopwatch(defaultTimer, store, cfg.Stopwatch, nil, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := parseImport([]byte("2024-05-06T09:00:00Z,2024-05-06T10:00:00Z,work\n2024-05-06T10:00:00Z,2024-05-06T11:00:00Z,home\n"), importCSV, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sw.Import(rows, false)
+	if err == nil {
+		t.Error("import without journal succeeded")
+	}
+
+	sessions, err := store.OverlappingSessions(time.Time{}, at(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 0 {
+		t.Errorf("%d sessions are left after failed import", len(sessions))
+	}
+}
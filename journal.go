@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// kinds of journaled actions
+const (
+	actionStart  = "start"
+	actionStop   = "stop"
+	actionSwitch = "switch"
+	actionNote   = "note"
+	actionCreate = "create"
+	actionEdit   = "edit"
+	actionDelete = "delete"
+	actionImport = "import"
+)
+
+var errNothingToUndo = errors.New("nothing to undo")
+var errNothingToRedo = errors.New("nothing to redo")
+var errReopenPreviousDay = errors.New("action would reopen a session of a previous day")
+
+// SessionChange is a change of one session made by an action
+// Before is nil for created sessions, After is nil for deleted ones
+type SessionChange struct {
+	Before *Session `json:"before"`
+	After  *Session `json:"after"`
+}
+
+// Action is a mutating stopwatch action saved to the journal,
+// it holds session states before and after the action
+// so that it can be undone and redone
+type Action struct {
+	ID      int64
+	Kind    string
+	Created time.Time
+	Changes []SessionChange
+	Undone  bool
+}
+
+// snapshot returns a copy of session to be saved in journal
+func snapshot(s *Session) *Session {
+	if s == nil {
+		return nil
+	}
+
+	c := *s
+	return &c
+}
+
+// record saves an action to the journal, undone actions are dropped
+// as they can't be redone after a new action.
+// Journal errors are only logged, they must not fail the action itself.
+// s.lock must be held by caller
+func (s *Stopwatch) record(kind string, changes ...SessionChange) {
+	err := s.saveAction(kind, changes)
+	if err != nil {
+		log.Printf("[journal] %s\n", err)
+	}
+}
+
+// saveAction saves an action to the journal like record does,
+// but returns an error if the action itself is not saved.
+// s.lock must be held by caller
+func (s *Stopwatch) saveAction(kind string, changes []SessionChange) error {
+	if s.config.JournalSize <= 0 {
+		return nil
+	}
+
+	err := s.store.DeleteUndoneActions()
+	if err != nil {
+		log.Printf("[journal] failed to delete undone actions: %s\n", err)
+	}
+
+	action := &Action{
+		Kind:    kind,
+		Created: s.clock.Now(),
+		Changes: changes,
+	}
+
+	err = s.store.InsertAction(action)
+	if err != nil {
+		return fmt.Errorf("failed to save %s action: %s", kind, err)
+	}
+
+	err = s.store.TrimActions(s.config.JournalSize)
+	if err != nil {
+		log.Printf("[journal] failed to trim journal: %s\n", err)
+	}
+
+	return nil
+}
+
+// Undo reverts the latest action that is not undone yet
+// and reloads sessions of current day
+func (s *Stopwatch) Undo() (*Action, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	action, err := s.store.LastAction(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if action == nil {
+		return nil, errNothingToUndo
+	}
+
+	for _, change := range action.Changes {
+		if s.reopensPreviousDay(change.Before) {
+			return nil, errReopenPreviousDay
+		}
+	}
+
+	for i := len(action.Changes) - 1; i >= 0; i-- {
+		change := action.Changes[i]
+		err = s.applyChange(change.After, change.Before)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.store.SetActionUndone(action.ID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return action, s.afterJournal()
+}
+
+// Redo applies the earliest undone action again
+// and reloads sessions of current day
+func (s *Stopwatch) Redo() (*Action, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	action, err := s.store.LastAction(true)
+	if err != nil {
+		return nil, err
+	}
+
+	if action == nil {
+		return nil, errNothingToRedo
+	}
+
+	for _, change := range action.Changes {
+		if s.reopensPreviousDay(change.After) {
+			return nil, errReopenPreviousDay
+		}
+	}
+
+	for _, change := range action.Changes {
+		err = s.applyChange(change.Before, change.After)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.store.SetActionUndone(action.ID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return action, s.afterJournal()
+}
+
+// reopensPreviousDay returns true if a session state is opened and started
+// before the current day, such a session would be split by nobody.
+// s.lock must be held by caller
+func (s *Stopwatch) reopensPreviousDay(state *Session) bool {
+	return state != nil && state.Opened && state.Start.Before(dayStart(s.DayStart, s.config))
+}
+
+// afterJournal reloads sessions after undo or redo and repairs a reopened
+// session that reached max session length, like the day split worker does.
+// s.lock must be held by caller
+func (s *Stopwatch) afterJournal() error {
+	err := s.LoadSessions()
+	if err != nil {
+		return err
+	}
+
+	_, repair, err := s.rollOverLocked(s.clock.Now(), true)
+	if repair != nil {
+		log.Printf("[journal] stopwatch %s: %s\n", s.Name, repair)
+	}
+
+	return err
+}
+
+// applyChange changes stored session from one state to another,
+// nil state means there is no session
+func (s *Stopwatch) applyChange(from *Session, to *Session) error {
+	if to == nil {
+		return s.store.DeleteSession(from.ID)
+	}
+
+	session := snapshot(to)
+	if from == nil {
+		return s.store.InsertSession(session)
+	}
+
+	return s.store.UpdateSession(session)
+}
+
+// writeJournalResponse writes stopwatch state after undo or redo,
+// or an error if it failed. Returns true if action was undone or redone
+func writeJournalResponse(w http.ResponseWriter, sw *Stopwatch, err error) bool {
+	if err == errNothingToUndo || err == errNothingToRedo || err == errReopenPreviousDay {
+		writeError(w, http.StatusConflict, errCodeConflict, err.Error())
+		return false
+	}
+
+	if err != nil {
+		writeInternalError(w, "failed to apply journal", err)
+		return false
+	}
+
+	writeResponse(w, sw)
+	return true
+}
@@ -1,73 +1,69 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"html/template"
 	"log"
 	"net/http"
 	"os"
-	"path"
-	"regexp"
-	"strconv"
-	"strings"
-	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 // TemplateData is a context for rendering HTML templates
+// HrefPrefix is a prefix of static files, StopwatchPrefix is a prefix
+// of API and pages of the stopwatch the template is rendered for.
+// Dashboard shows Days when statistics are grouped by day and Periods otherwise
 type TemplateData struct {
-	Days         []DayStat
-	PrevDate     string
-	NextDate     string
-	ElapsedTime  string
-	HrefPrefix   string
-	DayStartHour int
-}
-
-type websocketClient struct {
-	updates chan bool
-}
-
-// UpdatesWorker is a background worker that broadcasts update events of stopwatch
-// to all the clients connected via web sockets
-func UpdatesWorker(input <-chan bool, register <-chan *websocketClient, unregister <-chan *websocketClient) {
-	clients := make(map[*websocketClient]bool)
-	logPrefix := "[websocket-updates]"
-
-	for {
-		select {
-		case <-input:
-			for client := range clients {
-				select {
-				case client.updates <- true:
-				default:
-					log.Printf("%s failed to send, removing client", logPrefix)
-					delete(clients, client)
-					close(client.updates)
-				}
-			}
-		case client := <-register:
-			clients[client] = true
-		case client := <-unregister:
-			if _, ok := clients[client]; ok {
-				delete(clients, client)
-				close(client.updates)
-			}
-		}
-	}
+	Days            []DayStat
+	Periods         []PeriodStat
+	StatFrom        string
+	StatTo          string
+	Group           string
+	CalendarURL     string
+	Projects        []ProjectTotal
+	PrevDate        string
+	NextDate        string
+	ElapsedTime     string
+	HrefPrefix      string
+	StopwatchPrefix string
+	Timer           string
+	DayStart        int64
+	DayEnd          int64
 }
 
 // config-related flags
 var cfgPath = flag.String("config", "/usr/local/stopwatch/stopwatch.conf", "path to config file")
 var defaultCfgFlag = flag.Bool("default-config", false, "print default config and exit")
+var hashPasswordFlag = flag.Bool("hash-password", false, "read a password from stdin, print its hash for [http.auth.users] config section and exit")
+
+// database maintenance flags
+var migrateFlag = flag.Bool("migrate", false, "apply pending schema migrations and exit")
+var migrateStatusFlag = flag.Bool("migrate-status", false, "print schema migrations status and exit")
+var backupFlag = flag.String("backup", "", "write JSON backup of all users and sessions to a file and exit")
+var restoreFlag = flag.String("restore", "", "restore JSON backup from a file and exit, merges with existing data unless -replace is set")
+var replaceFlag = flag.Bool("replace", false, "delete all existing data before restore, used with -restore")
+
+// user management flags
+var addUserFlag = flag.String("add-user", "", "create a user with given name, print its API token and exit")
+var usersFlag = flag.Bool("users", false, "print all users and exit")
 
 // flags for CLI commands
 var startFlag = flag.Bool("start", false, "[CLI] start time")
 var stopFlag = flag.Bool("stop", false, "[CLI] stop time")
 var statusFlag = flag.Bool("status", false, "[CLI] show current status and time")
+var projectFlag = flag.String("project", "", "[CLI] project of the session to start, used with -start")
+var tagsFlag = flag.String("tags", "", "[CLI] comma-separated tags of the session to start, used with -start")
+var undoFlag = flag.Bool("undo", false, "[CLI] undo the last action")
+var redoFlag = flag.Bool("redo", false, "[CLI] redo the last undone action")
+var timerFlag = flag.String("timer", defaultTimer, "[CLI] name of the stopwatch to control")
+var noteFlag = flag.String("note", "", "[CLI] note of the session, used with -start and -stop")
+var statFlag = flag.Bool("stat", false, "[CLI] show statistics, last 7 days by default")
+var fromFlag = flag.String("from", "", "[CLI] first date of statistics in YYYY-MM-DD format, used with -stat")
+var toFlag = flag.String("to", "", "[CLI] last date of statistics in YYYY-MM-DD format, used with -stat")
+var exportFlag = flag.String("export", "", "[CLI] print CSV export of sessions or days in range set with -from, -to and -group")
+var importFlag = flag.String("import", "", "[CLI] import sessions from a file of format set with -format")
+var formatFlag = flag.String("format", importAuto, "[CLI] format of imported file: auto, csv, toggl or timewarrior, used with -import")
+var dryRunFlag = flag.Bool("dry-run", false, "[CLI] check imported file without saving sessions, used with -import")
+var groupFlag = flag.String("group", groupDay, "[CLI] period of statistics totals: day, week, month or year, used with -stat")
 
 func main() {
 	flag.Parse()
@@ -81,258 +77,103 @@ func main() {
 		return
 	}
 
-	cfg, err := ParseConfig(*cfgPath)
-	if err != nil {
-		log.Fatalf("failed to parse config: %s\n", err)
-		return
-	}
-
-	cliFlags := countClientFlags()
-	if cliFlags > 1 {
-		fmt.Fprintf(os.Stderr, "Only one CLI flag must be set")
-		return
-	}
-
-	if cliFlags == 1 {
-		// client mode
-		baseURL := getURL(cfg.HTTP)
-		runClient(baseURL)
+	if *hashPasswordFlag {
+		err := runHashPassword()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to hash password: %s\n", err)
+			os.Exit(1)
+		}
 		return
 	}
-	// server mode
 
-	sw, err := NewStopwatch(cfg)
+	cfg, err := ParseConfig(*cfgPath)
 	if err != nil {
-		log.Fatalf("failed to initialize stopwatch: %s\n", err)
+		log.Fatalf("failed to parse config: %s\n", err)
 		return
 	}
 
-	if cfg.Stopwatch.DisplayNotifications {
-		go NotificationWorker(sw.notifications)
-	}
-
-	log.Printf("started\n")
-
-	// a channel of all updates to stopwatch state, input for websocket worker
-	updates := make(chan bool)
-	register := make(chan *websocketClient)
-	unregister := make(chan *websocketClient)
-
-	go DaySplitWorker(sw, updates)
-	go UpdatesWorker(updates, register, unregister)
-
-	http.HandleFunc("/time", func(w http.ResponseWriter, r *http.Request) {
-		err := writeResponse(w, sw)
-
-		if err != nil {
-			log.Printf("failed to write response: %s\n", err)
-		}
-
-	})
-
-	http.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
-		err := sw.Start()
-
-		if err != nil {
-			log.Printf("failed to start: %s\n", err)
-			return
-		}
-
-		err = writeResponse(w, sw)
-
+	if *migrateFlag {
+		err := runMigrate(cfg.DB)
 		if err != nil {
-			log.Printf("failed to write response: %s\n", err)
-		}
-
-		updates <- true
-	})
-
-	http.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
-		err := sw.Stop()
-		if err != nil {
-			log.Printf("failed to stop: %s\n", err)
-			return
-		}
-
-		err = writeResponse(w, sw)
-
-		if err != nil {
-			log.Printf("failed to write response: %s\n", err)
-		}
-
-		updates <- true
-	})
-
-	http.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
-		sessionsAPI := make([]SessionAPIResponse, 0)
-
-		ts, ok := r.URL.Query()["time"]
-
-		if !ok {
-			for _, session := range sw.Sessions {
-				sessionsAPI = append(sessionsAPI, session.ToAPIResponse())
-			}
-
-			if sw.Session != nil {
-				sessionsAPI = append(sessionsAPI, sw.Session.ToAPIResponse())
-			}
-		} else {
-			tsInt, err := strconv.ParseInt(ts[0], 10, 64)
-			if err != nil {
-				log.Printf("failed to parse time: %s\n", err)
-				return
-			}
-
-			sessions, err := getAllSessions(sw.db, sw.config, millisToTime(tsInt))
-			if err != nil {
-				log.Printf("failed to load sessions: %s\n", err)
-				return
-			}
-
-			for _, session := range sessions {
-				sessionsAPI = append(sessionsAPI, session.ToAPIResponse())
-			}
-		}
-
-		data, err := json.Marshal(sessionsAPI)
-		if err != nil {
-			log.Printf("failed to marshal sessions: %s\n", err)
-			return
-		}
-
-		_, err = w.Write(data)
-		if err != nil {
-			log.Printf("failed to write response: %s\n", err)
-		}
-	})
-
-	http.HandleFunc("/stat", func(w http.ResponseWriter, r *http.Request) {
-		from := time.Now().Add(time.Hour * 24 * -7)
-		days, err := loadDayStats(sw.db, sw.config, from, time.Now())
-		if err != nil {
-			log.Printf("failed to load day stats: %s\n", err)
-			return
-		}
-
-		response := make([]DayStatAPIResponse, len(days))
-
-		for i, ds := range days {
-			response[i] = ds.ToAPIResponse()
+			fmt.Fprintf(os.Stderr, "migration failed: %s\n", err)
+			os.Exit(1)
 		}
+		return
+	}
 
-		data, err := json.Marshal(response)
+	if *migrateStatusFlag {
+		err := printMigrationStatus(cfg.DB)
 		if err != nil {
-			log.Printf("failed to marshal days stat: %s\n", err)
-			return
+			fmt.Fprintf(os.Stderr, "failed to get migration status: %s\n", err)
+			os.Exit(1)
 		}
+		return
+	}
 
-		_, err = w.Write(data)
+	if *backupFlag != "" {
+		err := runBackup(cfg.DB, *backupFlag)
 		if err != nil {
-			log.Printf("failed to write response: %s\n", err)
+			fmt.Fprintf(os.Stderr, "backup failed: %s\n", err)
+			os.Exit(1)
 		}
-	})
-
-	dateRe := regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})`)
-	http.HandleFunc("/stats/", func(w http.ResponseWriter, r *http.Request) {
-		splitURL := strings.Split(r.URL.Path, "/")
-		if len(splitURL) < 3 {
-			http.NotFound(w, r)
-			return
-		}
-
-		matches := dateRe.FindStringSubmatch(splitURL[2])
-		if matches == nil {
-			http.NotFound(w, r)
-			return
-		}
-
-		y, _ := strconv.Atoi(matches[1])
-		m, _ := strconv.Atoi(matches[2])
-		s, _ := strconv.Atoi(matches[3])
-
-		from := time.Date(y, time.Month(m), s, sw.config.DayStartHour, 0, 0, 0, time.Now().Location())
+		return
+	}
 
-		t, err := template.ParseFiles(path.Join(cfg.HTTP.StaticDir, "day_stat.html"))
+	if *restoreFlag != "" {
+		err := runRestore(cfg.DB, *restoreFlag, *replaceFlag)
 		if err != nil {
-			log.Printf("failed to parse day stat template file: %s\n", err)
-			return
+			fmt.Fprintf(os.Stderr, "restore failed: %s\n", err)
+			os.Exit(1)
 		}
+		return
+	}
 
-		days, err := loadDayStats(sw.db, sw.config, from, from.Add(time.Hour*24))
-
-		if len(days) == 0 {
-			http.NotFound(w, r)
-			return
-		}
-
-		err = t.Execute(w, TemplateData{
-			HrefPrefix:   cfg.HTTP.HrefPrefix,
-			ElapsedTime:  formatElapsedTime(days[0].ElapsedTime),
-			DayStartHour: cfg.Stopwatch.DayStartHour,
-		})
-
+	if *addUserFlag != "" {
+		err := runAddUser(cfg.DB, *addUserFlag)
 		if err != nil {
-			log.Printf("failed to exec template: %s\n", err)
+			fmt.Fprintf(os.Stderr, "failed to add user: %s\n", err)
+			os.Exit(1)
 		}
-	})
-
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		return
 	}
 
-	http.HandleFunc("/updates", func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
+	if *usersFlag {
+		err := printUsers(cfg.DB)
 		if err != nil {
-			log.Printf("failed to upgrade connection: %s", err)
-			return
-		}
-		clientUpdates := make(chan bool)
-
-		client := &websocketClient{
-			updates: clientUpdates,
+			fmt.Fprintf(os.Stderr, "failed to get users: %s\n", err)
+			os.Exit(1)
 		}
-		register <- client
-		defer func() {
-			unregister <- client
-		}()
+		return
+	}
 
-		for _ = range client.updates {
-			err := conn.WriteMessage(websocket.TextMessage, []byte("update"))
-			if err != nil {
-				log.Printf("failed to write message: %s", err)
-				return
-			}
-		}
-	})
+	cliFlags := countClientFlags()
+	if cliFlags > 1 {
+		fmt.Fprintf(os.Stderr, "Only one CLI flag must be set")
+		return
+	}
 
-	http.Handle("/js/", http.FileServer(http.Dir(cfg.HTTP.StaticDir)))
-	http.Handle("/css/", http.FileServer(http.Dir(cfg.HTTP.StaticDir)))
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		t, err := template.ParseFiles(path.Join(cfg.HTTP.StaticDir, "stopwatch.html"))
-		if err != nil {
-			log.Printf("failed to parse main template file: %s\n", err)
-			return
-		}
+	if cliFlags == 1 {
+		// client mode
+		baseURL := getURL(cfg.HTTP, *timerFlag)
+		runClient(baseURL, clientCredentials(cfg.Client))
+		return
+	}
+	// server mode
 
-		from := time.Now().Add(time.Hour * 24 * -7)
-		days, err := loadDayStats(sw.db, sw.config, from, time.Now())
-		if err != nil {
-			log.Printf("failed to load day stats: %s\n", err)
-			return
-		}
+	err = openLog(cfg.Stopwatch)
+	if err != nil {
+		log.Fatalf("failed to open log: %s\n", err)
+		return
+	}
 
-		err = t.Execute(w, TemplateData{
-			HrefPrefix:   cfg.HTTP.HrefPrefix,
-			Days:         days,
-			DayStartHour: cfg.Stopwatch.DayStartHour,
-		})
+	srv, err := NewServer(cfg, systemClock)
+	if err != nil {
+		log.Fatalf("failed to initialize stopwatch: %s\n", err)
+		return
+	}
 
-		if err != nil {
-			log.Printf("failed to exec template: %s\n", err)
-		}
-	})
+	log.Printf("started\n")
 
 	addr := fmt.Sprintf(":%d", cfg.HTTP.Port)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	log.Fatal(http.ListenAndServe(addr, srv))
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+)
+
+// migration is a numbered change of the database schema.
+// Statements are listed separately for every SQL dialect.
+// MySQL commits DDL statements implicitly, so a MySQL migration must
+// consist of a single statement to be applied atomically with its version
+type migration struct {
+	version     int
+	description string
+	mysql       []string
+	sqlite      []string
+}
+
+// migrations are applied in order, a new migration must be appended
+// to the end of the list with the next version number.
+// Applied migrations must never be changed
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create sessions table",
+		mysql: []string{
+			"create table if not exists sessions (start bigint(20) default null, end bigint(20) default null, key start (start)) engine=InnoDB default charset=utf8",
+		},
+		sqlite: []string{
+			"create table if not exists sessions (start integer default null, end integer default null)",
+			"create index if not exists sessions_start on sessions (start)",
+		},
+	},
+	{
+		version:     2,
+		description: "add id column to sessions",
+		mysql: []string{
+			"alter table sessions add column id bigint(20) not null auto_increment primary key first",
+		},
+		sqlite: []string{
+			"create table sessions_new (id integer primary key autoincrement, start integer default null, end integer default null)",
+			"insert into sessions_new (start, end) select start, end from sessions order by start",
+			"drop table sessions",
+			"alter table sessions_new rename to sessions",
+			"create index if not exists sessions_start on sessions (start)",
+		},
+	},
+	{
+		version:     3,
+		description: "add project and tags columns to sessions",
+		mysql: []string{
+			"alter table sessions add column project varchar(255) not null default '', add column tags varchar(1024) not null default ''",
+		},
+		sqlite: []string{
+			"alter table sessions add column project text not null default ''",
+			"alter table sessions add column tags text not null default ''",
+		},
+	},
+	{
+		version:     4,
+		description: "add note column to sessions",
+		mysql: []string{
+			"alter table sessions add column note varchar(4096) not null default ''",
+		},
+		sqlite: []string{
+			"alter table sessions add column note text not null default ''",
+		},
+	},
+	{
+		version:     5,
+		description: "create actions table for undo journal",
+		mysql: []string{
+			"create table if not exists actions (id bigint(20) not null auto_increment primary key, kind varchar(32) not null, created bigint(20) not null, changes text not null, undone tinyint(1) not null default 0) engine=InnoDB default charset=utf8",
+		},
+		sqlite: []string{
+			"create table if not exists actions (id integer primary key autoincrement, kind text not null, created integer not null, changes text not null, undone integer not null default 0)",
+		},
+	},
+	{
+		version:     6,
+		description: "add timer column to sessions",
+		mysql: []string{
+			"alter table sessions add column timer varchar(64) not null default 'default', add key timer_start (timer, start)",
+		},
+		sqlite: []string{
+			"alter table sessions add column timer text not null default 'default'",
+			"create index if not exists sessions_timer_start on sessions (timer, start)",
+		},
+	},
+	{
+		version:     7,
+		description: "add timer column to actions",
+		mysql: []string{
+			"alter table actions add column timer varchar(64) not null default 'default', add key timer_id (timer, id)",
+		},
+		sqlite: []string{
+			"alter table actions add column timer text not null default 'default'",
+			"create index if not exists actions_timer_id on actions (timer, id)",
+		},
+	},
+	{
+		version:     8,
+		description: "create users table",
+		mysql: []string{
+			"create table if not exists users (id bigint(20) not null auto_increment primary key, name varchar(255) not null, token_hash char(64) not null, created bigint(20) not null, unique key name (name), unique key token_hash (token_hash)) engine=InnoDB default charset=utf8",
+		},
+		sqlite: []string{
+			"create table if not exists users (id integer primary key autoincrement, name text not null unique, token_hash text not null unique, created integer not null)",
+		},
+	},
+	{
+		version:     9,
+		description: "add user_id column to sessions",
+		mysql: []string{
+			"alter table sessions add column user_id bigint(20) not null default 0, drop key timer_start, add key user_timer_start (user_id, timer, start)",
+		},
+		sqlite: []string{
+			"alter table sessions add column user_id integer not null default 0",
+			"drop index if exists sessions_timer_start",
+			"create index if not exists sessions_user_timer_start on sessions (user_id, timer, start)",
+		},
+	},
+	{
+		version:     10,
+		description: "add user_id column to actions",
+		mysql: []string{
+			"alter table actions add column user_id bigint(20) not null default 0, drop key timer_id, add key user_timer_id (user_id, timer, id)",
+		},
+		sqlite: []string{
+			"alter table actions add column user_id integer not null default 0",
+			"drop index if exists actions_timer_id",
+			"create index if not exists actions_user_timer_id on actions (user_id, timer, id)",
+		},
+	},
+	{
+		version:     11,
+		description: "make changes column of actions longtext",
+		mysql: []string{
+			"alter table actions modify changes longtext not null",
+		},
+		// text of SQLite has no length limit
+		sqlite: []string{},
+	},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func (m migration) statements(dialect string) []string {
+	if dialect == driverSQLite {
+		return m.sqlite
+	}
+
+	return m.mysql
+}
+
+// MigrationStatus describes a migration and whether it's applied to the store
+type MigrationStatus struct {
+	Version     int
+	Description string
+	Applied     bool
+}
+
+func getMigrationStatus(store Store) ([]MigrationStatus, error) {
+	current, err := store.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		statuses[i] = MigrationStatus{
+			Version:     m.version,
+			Description: m.description,
+			Applied:     m.version <= current,
+		}
+	}
+
+	return statuses, nil
+}
+
+// runMigrate applies pending migrations and prints schema version, used in -migrate mode
+func runMigrate(cfg *DBConfig) error {
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	before, err := store.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	err = store.Migrate()
+	if err != nil {
+		return err
+	}
+
+	if before == latestSchemaVersion() {
+		fmt.Printf("schema is up to date (version %d)\n", before)
+	} else {
+		fmt.Printf("schema migrated from version %d to %d\n", before, latestSchemaVersion())
+	}
+
+	return nil
+}
+
+// printMigrationStatus prints all known migrations and their state, used in -migrate-status mode
+func printMigrationStatus(cfg *DBConfig) error {
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	statuses, err := getMigrationStatus(store)
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		state := "pending"
+		if status.Applied {
+			state = "applied"
+		}
+		fmt.Printf("%4d  %-8s %s\n", status.Version, state, status.Description)
+	}
+
+	return nil
+}
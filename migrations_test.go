@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestMigrations(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d has version %d", i+1, m.version)
+		}
+
+		// MySQL DDL is committed implicitly, a failed statement
+		// must not leave previous ones applied without the version
+		if len(m.mysql) != 1 {
+			t.Errorf("migration %d has %d MySQL statements, expected 1", m.version, len(m.mysql))
+		}
+
+		// an empty list means the change is not needed in SQLite
+		if m.sqlite == nil {
+			t.Errorf("migration %d has no SQLite statements", m.version)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// apiParam is a query or path parameter of API operation
+type apiParam struct {
+	name        string
+	in          string
+	description string
+	schema      string
+}
+
+// apiOperation describes an API v2 endpoint for OpenAPI document.
+// Request and response are zero values of Go types sent over the wire,
+// their schemas are generated with reflection so that the document
+// can't get out of sync with the types
+type apiOperation struct {
+	method   string
+	path     string
+	summary  string
+	params   []apiParam
+	request  interface{}
+	status   int
+	response interface{}
+	// content type of responses that are not JSON
+	contentType string
+	// content type of request body that is not JSON
+	requestType string
+	// served only without /w/{timer} prefix, as it isn't an operation of a stopwatch
+	rootOnly bool
+}
+
+var sessionIDParam = apiParam{"id", "path", "session ID", "integer"}
+
+var statParams = []apiParam{
+	{"from", "query", "first date in YYYY-MM-DD format, 6 days before to by default", "string"},
+	{"to", "query", "last date in YYYY-MM-DD format, today by default", "string"},
+	{"group", "query", "period of totals: day (default), week, month or year", "string"},
+}
+
+var apiOperations = []apiOperation{
+	{method: "get", path: "/time", summary: "Current state of stopwatch",
+		status: http.StatusOK, response: APIResponse{}},
+	{method: "post", path: "/start", summary: "Start stopwatch or switch it to another project",
+		params: []apiParam{
+			{"project", "query", "project name", "string"},
+			{"tags", "query", "comma-separated tags", "string"},
+			{"note", "query", "note of the session", "string"},
+		},
+		status: http.StatusOK, response: APIResponse{}},
+	{method: "post", path: "/stop", summary: "Stop stopwatch",
+		params: []apiParam{{"note", "query", "note of the closed session", "string"}},
+		status: http.StatusOK, response: APIResponse{}},
+	{method: "post", path: "/undo", summary: "Undo the latest action",
+		status: http.StatusOK, response: APIResponse{}},
+	{method: "post", path: "/redo", summary: "Redo the latest undone action",
+		status: http.StatusOK, response: APIResponse{}},
+	{method: "get", path: "/sessions", summary: "Sessions of current day or of the day containing time",
+		params: []apiParam{{"time", "query", "Unix time in milliseconds", "integer"}},
+		status: http.StatusOK, response: []SessionAPIResponse{}},
+	{method: "post", path: "/sessions", summary: "Create a past session",
+		request: SessionRequest{},
+		status:  http.StatusCreated, response: SessionAPIResponse{}},
+	{method: "get", path: "/sessions/search", summary: "Search sessions by note",
+		params: []apiParam{{"q", "query", "search text", "string"}},
+		status: http.StatusOK, response: []SessionAPIResponse{}},
+	{method: "get", path: "/sessions/{id}", summary: "Get a session",
+		params: []apiParam{sessionIDParam},
+		status: http.StatusOK, response: SessionAPIResponse{}},
+	{method: "put", path: "/sessions/{id}", summary: "Replace a session",
+		params: []apiParam{sessionIDParam}, request: SessionRequest{},
+		status: http.StatusOK, response: SessionAPIResponse{}},
+	{method: "patch", path: "/sessions/{id}", summary: "Change fields of a session",
+		params: []apiParam{sessionIDParam}, request: SessionPatchRequest{},
+		status: http.StatusOK, response: SessionAPIResponse{}},
+	{method: "delete", path: "/sessions/{id}", summary: "Delete a session",
+		params: []apiParam{sessionIDParam},
+		status: http.StatusNoContent},
+	{method: "get", path: "/stat", summary: "Totals of a range of dates grouped by periods",
+		params: statParams,
+		status: http.StatusOK, response: []PeriodStatAPIResponse{}},
+	{method: "get", path: "/export/sessions.csv", summary: "Closed sessions started in a range of dates",
+		params: append(statParams, apiParam{"time_format", "query", "rfc3339 or millis, set in config by default", "string"}),
+		status: http.StatusOK, contentType: "text/csv"},
+	{method: "post", path: "/import", summary: "Import sessions from CSV, Toggl CSV or Timewarrior data file sent as body",
+		params: []apiParam{
+			{"format", "query", "auto (default), csv, toggl or timewarrior", "string"},
+			{"dry_run", "query", "only check rows if set, nothing is saved", "string"},
+		},
+		requestType: "text/plain",
+		status:      http.StatusOK, response: ImportResult{}},
+	{method: "get", path: "/calendar-url", summary: "URL of iCalendar feed of the stopwatch with a secret key",
+		status: http.StatusOK, response: CalendarURLAPIResponse{}},
+	{method: "get", path: "/export/days.csv", summary: "Totals of periods per project",
+		params: statParams,
+		status: http.StatusOK, contentType: "text/csv"},
+	{method: "get", path: "/events", summary: "Server-Sent Events stream of stopwatch state changes, each event data is Event JSON",
+		params: []apiParam{{"last_event_id", "query", "resume after this event, Last-Event-ID header is used too", "integer"}},
+		status: http.StatusOK, contentType: "text/event-stream"},
+	{method: "get", path: "/backup", summary: "Backup of all users and sessions, administrators only",
+		status: http.StatusOK, response: Backup{}, rootOnly: true},
+	{method: "post", path: "/restore", summary: "Restore backup of all users and sessions, administrators only",
+		params:  []apiParam{{"mode", "query", "merge or replace", "string"}},
+		request: Backup{},
+		status:  http.StatusOK, response: RestoreResult{}, rootOnly: true},
+}
+
+// handleOpenAPI serves OpenAPI 3 document of API v2
+func (srv *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, openAPIDocument(srv.config.HTTP.HrefPrefix))
+}
+
+// openAPIDocument builds OpenAPI 3 document of API v2 from apiOperations.
+// Operations are served for the default and named stopwatches,
+// root-only ones override servers with the default one
+func openAPIDocument(hrefPrefix string) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]interface{}{}
+
+	root := map[string]interface{}{
+		"url":         hrefPrefix + "/",
+		"description": "default stopwatch",
+	}
+	named := map[string]interface{}{
+		"url":         hrefPrefix + "/w/{timer}/",
+		"description": "named stopwatch",
+		"variables": map[string]interface{}{
+			"timer": map[string]interface{}{"default": defaultTimer},
+		},
+	}
+
+	for _, op := range apiOperations {
+		operation := map[string]interface{}{
+			"summary": op.summary,
+			"responses": map[string]interface{}{
+				"default": jsonContent("error", schemaRef(schemas, reflect.TypeOf(APIError{}))),
+			},
+		}
+
+		if op.rootOnly {
+			operation["servers"] = []interface{}{root}
+		}
+
+		if len(op.params) > 0 {
+			var params []interface{}
+			for _, p := range op.params {
+				params = append(params, map[string]interface{}{
+					"name":        p.name,
+					"in":          p.in,
+					"description": p.description,
+					"required":    p.in == "path",
+					"schema":      map[string]interface{}{"type": p.schema},
+				})
+			}
+			operation["parameters"] = params
+		}
+
+		if op.requestType != "" {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					op.requestType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				},
+			}
+		} else if op.request != nil {
+			body := jsonContent("", schemaRef(schemas, reflect.TypeOf(op.request)))
+			body["required"] = true
+			delete(body, "description")
+			operation["requestBody"] = body
+		}
+
+		responses := operation["responses"].(map[string]interface{})
+		if op.contentType != "" {
+			responses[strconv.Itoa(op.status)] = map[string]interface{}{
+				"description": http.StatusText(op.status),
+				"content": map[string]interface{}{
+					op.contentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				},
+			}
+		} else if op.response != nil {
+			responses[strconv.Itoa(op.status)] = jsonContent(http.StatusText(op.status), schemaRef(schemas, reflect.TypeOf(op.response)))
+		} else {
+			responses[strconv.Itoa(op.status)] = map[string]interface{}{"description": http.StatusText(op.status)}
+		}
+
+		item, ok := paths[apiV2Prefix+op.path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[apiV2Prefix+op.path] = item
+		}
+		item[op.method] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Stopwatch API",
+			"version": "2",
+		},
+		"servers": []interface{}{root, named},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+		},
+	}
+}
+
+func jsonContent(description string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schema},
+		},
+	}
+}
+
+// schemaRef returns schema of type t, named struct types are added
+// to schemas and referenced
+func schemaRef(schemas map[string]interface{}, t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if _, ok := schemas[t.Name()]; !ok {
+			// placeholder guards against recursive types
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = structSchema(schemas, t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaRef(schemas, t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaRef(schemas, t.Elem())}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+// structSchema returns object schema of struct fields as they are
+// encoded by encoding/json. Fields without omitempty are required,
+// pointer fields are optional and nullable
+func structSchema(schemas map[string]interface{}, t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Name
+		omitEmpty := false
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			split := strings.Split(tag, ",")
+			if split[0] == "-" {
+				continue
+			}
+			if split[0] != "" {
+				name = split[0]
+			}
+			for _, opt := range split[1:] {
+				omitEmpty = omitEmpty || opt == "omitempty"
+			}
+		}
+
+		schema := schemaRef(schemas, field.Type)
+		if field.Type.Kind() == reflect.Ptr {
+			if _, ok := schema["$ref"]; !ok {
+				schema["nullable"] = true
+			}
+		} else if !omitEmpty {
+			required = append(required, name)
+		}
+
+		properties[name] = schema
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "test-admin-token"
+
+// apiTestRequest is a request to an operation of apiOperations,
+// {id} in url is replaced with ID of the session created by the test
+type apiTestRequest struct {
+	method string
+	path   string
+	url    string
+	body   string
+}
+
+func ms(t time.Time) string {
+	return fmt.Sprint(millis(t))
+}
+
+// requests are made in order, every operation of apiOperations must be here
+var apiTestRequests = []apiTestRequest{
+	{"get", "/time", "/time", ""},
+	{"post", "/sessions", "/sessions", `{"start": ` + ms(at(0, 9, 0)) + `, "end": ` + ms(at(0, 10, 0)) + `, "project": "work", "tags": ["a"], "note": "planning"}`},
+	{"post", "/start", "/start?project=work&tags=a,b&note=coding", ""},
+	{"post", "/stop", "/stop?note=done", ""},
+	{"post", "/undo", "/undo", ""},
+	{"post", "/redo", "/redo", ""},
+	{"get", "/sessions", "/sessions", ""},
+	{"get", "/sessions/search", "/sessions/search?q=plan", ""},
+	{"get", "/sessions/{id}", "/sessions/{id}", ""},
+	{"put", "/sessions/{id}", "/sessions/{id}", `{"start": ` + ms(at(0, 9, 0)) + `, "end": ` + ms(at(0, 10, 30)) + `, "project": "work", "note": "planning"}`},
+	{"patch", "/sessions/{id}", "/sessions/{id}", `{"note": "planning and review"}`},
+	{"get", "/stat", "/stat?from=2024-05-01&to=2024-05-06&group=week", ""},
+	{"get", "/export/sessions.csv", "/export/sessions.csv?from=2024-05-01&to=2024-05-06", ""},
+	{"get", "/export/days.csv", "/export/days.csv?from=2024-05-01&to=2024-05-06", ""},
+	{"post", "/import", "/import?dry_run=1", "start,end,project,note\n2024-05-05T09:00:00Z,2024-05-05T10:00:00Z,home,imported\n"},
+	{"get", "/calendar-url", "/calendar-url", ""},
+	{"get", "/events", "/events", ""},
+	{"get", "/backup", "/backup", ""},
+	{"post", "/restore", "/restore?mode=merge", "{backup}"},
+	{"delete", "/sessions/{id}", "/sessions/{id}", ""},
+}
+
+func TestAPIOperations(t *testing.T) {
+	srv := newTestServer(t, NewFakeClock(at(0, 12, 0)), func(cfg *Config) {
+		cfg.HTTP.MultiUser = false
+		cfg.HTTP.Auth.Enabled = true
+		cfg.HTTP.Auth.Tokens = []string{testAdminToken}
+		cfg.Calendar.Secret = "test-secret"
+	})
+
+	doc := openAPIDocument("")
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+	operations := map[string]apiOperation{}
+	for _, op := range apiOperations {
+		operations[op.method+" "+op.path] = op
+	}
+
+	sessionID := ""
+	backup := ""
+
+	for _, req := range apiTestRequests {
+		key := req.method + " " + req.path
+		op, ok := operations[key]
+		if !ok {
+			t.Errorf("%s is not in apiOperations", key)
+			continue
+		}
+		delete(operations, key)
+
+		url := apiV2Prefix + strings.Replace(req.url, "{id}", sessionID, 1)
+		body := strings.Replace(req.body, "{backup}", backup, 1)
+		resp := apiRequest(srv, strings.ToUpper(req.method), url, body)
+
+		if resp.Code != op.status {
+			t.Errorf("%s: status %d, expected %d: %s", key, resp.Code, op.status, resp.Body)
+			continue
+		}
+
+		contentType := op.contentType
+		if contentType == "" && op.response != nil {
+			contentType = "application/json"
+		}
+
+		if contentType == "" {
+			if resp.Body.Len() != 0 {
+				t.Errorf("%s: unexpected body %s", key, resp.Body)
+			}
+			continue
+		}
+
+		mediaType, _, err := mime.ParseMediaType(resp.Header().Get("Content-Type"))
+		if err != nil || mediaType != contentType {
+			t.Errorf("%s: content type %q, expected %s", key, resp.Header().Get("Content-Type"), contentType)
+			continue
+		}
+
+		if op.response == nil {
+			continue
+		}
+
+		var value interface{}
+		err = json.Unmarshal(resp.Body.Bytes(), &value)
+		if err != nil {
+			t.Errorf("%s: invalid JSON: %s", key, err)
+			continue
+		}
+
+		responses := doc["paths"].(map[string]interface{})[apiV2Prefix+op.path].(map[string]interface{})[op.method].(map[string]interface{})["responses"].(map[string]interface{})
+		content := responses[fmt.Sprint(op.status)].(map[string]interface{})["content"].(map[string]interface{})
+		schema := content["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+
+		for _, problem := range checkSchema(schemas, schema, value, "response") {
+			t.Errorf("%s: %s", key, problem)
+		}
+
+		switch key {
+		case "post /sessions":
+			sessionID = fmt.Sprint(value.(map[string]interface{})["id"])
+		case "get /backup":
+			backup = resp.Body.String()
+		}
+	}
+
+	for key := range operations {
+		t.Errorf("%s is not tested", key)
+	}
+}
+
+func TestRootOnlyOperations(t *testing.T) {
+	srv := newTestServer(t, NewFakeClock(at(0, 12, 0)), func(cfg *Config) {
+		cfg.HTTP.MultiUser = false
+		cfg.HTTP.Auth.Enabled = true
+		cfg.HTTP.Auth.Tokens = []string{testAdminToken}
+	})
+
+	doc := openAPIDocument("")
+	paths := doc["paths"].(map[string]interface{})
+
+	for _, op := range apiOperations {
+		servers, _ := paths[apiV2Prefix+op.path].(map[string]interface{})[op.method].(map[string]interface{})["servers"].([]interface{})
+		if op.rootOnly != (len(servers) == 1) {
+			t.Errorf("%s %s has servers %v", op.method, op.path, servers)
+		}
+
+		if !op.rootOnly {
+			continue
+		}
+
+		resp := apiRequest(srv, strings.ToUpper(op.method), "/w/study"+apiV2Prefix+op.path, "")
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("%s %s of named stopwatch has status %d", op.method, op.path, resp.Code)
+		}
+	}
+}
+
+func TestAPISearchMatchesNotes(t *testing.T) {
+	srv := newTestServer(t, NewFakeClock(at(0, 12, 0)), func(cfg *Config) {
+		cfg.HTTP.MultiUser = false
+	})
+
+	for _, body := range []string{
+		`{"start": ` + ms(at(0, 9, 0)) + `, "end": ` + ms(at(0, 10, 0)) + `, "project": "planning", "tags": ["planning"]}`,
+		`{"start": ` + ms(at(0, 10, 0)) + `, "end": ` + ms(at(0, 11, 0)) + `, "project": "work", "note": "Sprint planning"}`,
+	} {
+		resp := apiRequest(srv, http.MethodPost, apiV2Prefix+"/sessions", body)
+		if resp.Code != http.StatusCreated {
+			t.Fatalf("failed to create session: %s", resp.Body)
+		}
+	}
+
+	resp := apiRequest(srv, http.MethodGet, apiV2Prefix+"/sessions/search?q=planning", "")
+
+	var sessions []SessionAPIResponse
+	err := json.Unmarshal(resp.Body.Bytes(), &sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Note != "Sprint planning" {
+		t.Errorf("search by note returned %+v", sessions)
+	}
+}
+
+// apiRequest makes a request to server with admin token.
+// Streams are closed once handler writes headers
+func apiRequest(srv *Server, method string, url string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	cancel()
+	r = r.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	return w
+}
+
+// checkSchema checks JSON value against schema of OpenAPI document,
+// returns descriptions of mismatches. Objects must have required properties
+// and must not have properties missing in schema
+func checkSchema(schemas map[string]interface{}, schema map[string]interface{}, value interface{}, path string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		schema = schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{})
+	}
+
+	if value == nil {
+		if schema["nullable"] != true {
+			return []string{fmt.Sprintf("%s is null", path)}
+		}
+		return nil
+	}
+
+	var problems []string
+	mismatch := func() []string {
+		return []string{fmt.Sprintf("%s is %T, expected %s", path, value, schema["type"])}
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+
+		required, _ := schema["required"].([]string)
+		for _, name := range required {
+			if _, ok := obj[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s has no required property %s", path, name))
+			}
+		}
+
+		properties, hasProperties := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+
+		for name, v := range obj {
+			property, ok := properties[name].(map[string]interface{})
+			if !ok && hasProperties {
+				problems = append(problems, fmt.Sprintf("%s has property %s missing in schema", path, name))
+				continue
+			}
+			if !ok {
+				property = additional
+			}
+			problems = append(problems, checkSchema(schemas, property, v, path+"."+name)...)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+
+		for i, item := range items {
+			problems = append(problems, checkSchema(schemas, schema["items"].(map[string]interface{}), item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return mismatch()
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return mismatch()
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return mismatch()
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return mismatch()
+		}
+	}
+
+	return problems
+}
+
+// TestAPIDuringRollover reads state while the worker rolls the day over,
+// it's meant to be run with -race
+func TestAPIDuringRollover(t *testing.T) {
+	clock := NewFakeClock(at(0, 23, 0))
+	srv := newTestServer(t, clock, func(cfg *Config) {
+		cfg.HTTP.MultiUser = false
+	})
+
+	resp := apiRequest(srv, http.MethodPost, apiV2Prefix+"/start?project=work", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("failed to start: %s", resp.Body)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			for _, url := range []string{"/time", "/sessions"} {
+				apiRequest(srv, http.MethodGet, apiV2Prefix+url, "")
+			}
+		}
+	}()
+
+	for clock.Now().Before(at(1, 9, 0)) {
+		waitSleeping(t, clock)
+		clock.Advance(10 * time.Minute)
+	}
+
+	close(stop)
+	<-done
+}
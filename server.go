@@ -0,0 +1,458 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultTimer is the name of the stopwatch served without /w/{name} prefix
+const defaultTimer = "default"
+
+var timerNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// stopwatchIdleTimeout is the time since the last request to a stopwatch
+// after which it can be unloaded if it has no subscribers
+const stopwatchIdleTimeout = 10 * time.Minute
+
+// errTooManyStopwatches is returned when a new stopwatch
+// can't be loaded as none of loaded ones is idle
+var errTooManyStopwatches = errors.New("too many stopwatches are in use")
+
+// Server serves HTTP API and UI for named stopwatches of all users.
+// Stopwatches are loaded on first request to them and stay in memory
+// until idle ones are unloaded to keep at most max_stopwatches.
+// Each stopwatch instance belongs to one user, so events
+// of a stopwatch reach only its owner's clients
+type Server struct {
+	config        *Config
+	store         Store
+	notifications chan Notification
+	clock         Clock
+
+	lock        sync.Mutex
+	stopwatches map[Scope]*loadedStopwatch
+	basicAuth   basicAuthCache
+
+	hub      *Hub
+	upgrader websocket.Upgrader
+}
+
+// loadedStopwatch is a stopwatch in memory, closing stop ends its day split worker
+type loadedStopwatch struct {
+	sw   *Stopwatch
+	stop chan struct{}
+	used time.Time
+}
+
+// NewServer opens a store, migrates its schema and loads
+// the default stopwatch of anonymous user in single-user mode.
+// Stopwatches and their workers take time from clock
+func NewServer(cfg *Config, clock Clock) (*Server, error) {
+	store, err := openStore(cfg.DB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %s", err)
+	}
+
+	err = store.Migrate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate schema: %s", err)
+	}
+
+	srv := &Server{
+		config:      cfg,
+		store:       store,
+		stopwatches: make(map[Scope]*loadedStopwatch),
+		clock:       clock,
+		hub:         NewHub(),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
+	}
+
+	if cfg.Stopwatch.DisplayNotifications {
+		srv.notifications = make(chan Notification)
+		go NotificationWorker(srv.notifications)
+	}
+
+	if !cfg.HTTP.MultiUser {
+		_, err = srv.Stopwatch(Scope{Timer: defaultTimer})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return srv, nil
+}
+
+// Stopwatch returns a stopwatch of a user by name, it's loaded
+// from the store, rolled over to current day and its day split
+// worker is started on first call. If max_stopwatches are loaded,
+// idle ones are unloaded first, errTooManyStopwatches is returned if there are none
+func (srv *Server) Stopwatch(scope Scope) (*Stopwatch, error) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	now := srv.clock.Now()
+
+	if loaded, ok := srv.stopwatches[scope]; ok {
+		loaded.used = now
+		return loaded.sw, nil
+	}
+
+	if len(srv.stopwatches) >= srv.config.HTTP.MaxStopwatches {
+		srv.unloadIdle(now)
+	}
+
+	if len(srv.stopwatches) >= srv.config.HTTP.MaxStopwatches {
+		return nil, errTooManyStopwatches
+	}
+
+	sw, err := NewStopwatch(scope.Timer, srv.store.WithScope(scope), srv.config.Stopwatch, srv.notifications, srv.clock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stopwatch %s of user %d: %s", scope.Timer, scope.UserID, err)
+	}
+
+	// catch up with days passed while server was down
+	_, repair, err := sw.rollOver(now, true)
+	if err != nil {
+		log.Printf("failed to roll over stopwatch %s of user %d: %s\n", scope.Timer, scope.UserID, err)
+	} else if repair != nil {
+		log.Printf("[repair] stopwatch %s of user %d: %s\n", scope.Timer, scope.UserID, repair)
+	}
+
+	loaded := &loadedStopwatch{sw: sw, stop: make(chan struct{}), used: now}
+	srv.stopwatches[scope] = loaded
+	go DaySplitWorker(sw, srv.hub, loaded.stop)
+
+	return sw, nil
+}
+
+// unloadIdle unloads stopwatches that had no requests for stopwatchIdleTimeout
+// and have no subscribers, their workers are stopped. Sessions are in the store,
+// so an unloaded stopwatch is loaded again on the next request.
+// srv.lock must be held by caller
+func (srv *Server) unloadIdle(now time.Time) {
+	for scope, loaded := range srv.stopwatches {
+		if now.Sub(loaded.used) < stopwatchIdleTimeout || srv.hub.Subscribed(loaded.sw) {
+			continue
+		}
+
+		close(loaded.stop)
+		delete(srv.stopwatches, scope)
+
+		log.Printf("stopwatch %s of user %d is unloaded as idle\n", scope.Timer, scope.UserID)
+	}
+}
+
+// ServeHTTP routes requests to static files, default stopwatch
+// or to a named stopwatch if path starts with /w/{name}/.
+// Stopwatches are looked up among the ones of authenticated user.
+// HTTP authentication, if enabled, is required for all requests
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, p, ok := splitTimerPath(r.URL.Path)
+
+	if ok && p == "/calendar.ics" {
+		srv.handleCalendar(w, withPath(r, p), name)
+		return
+	}
+
+	if !srv.authorized(w, r) {
+		requireAuth(w)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/js/") || strings.HasPrefix(r.URL.Path, "/css/") {
+		http.FileServer(http.Dir(srv.config.HTTP.StaticDir)).ServeHTTP(w, r)
+		return
+	}
+
+	if r.URL.Path == "/openapi.json" {
+		srv.handleOpenAPI(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/backup", apiV2Prefix + "/backup":
+		srv.handleBackup(w, r)
+		return
+	case "/restore", apiV2Prefix + "/restore":
+		srv.handleRestore(w, r)
+		return
+	}
+
+	user := srv.authenticate(w, r)
+	if user == nil {
+		return
+	}
+
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "invalid stopwatch name")
+		return
+	}
+
+	sw, err := srv.Stopwatch(Scope{UserID: user.ID, Timer: name})
+	if err == errTooManyStopwatches {
+		writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		writeInternalError(w, "failed to load stopwatch", err)
+		return
+	}
+
+	// handlers see paths relative to stopwatch prefix
+	srv.serveStopwatch(w, withPath(r, p), sw)
+}
+
+// splitTimerPath returns stopwatch name and path relative to stopwatch prefix,
+// ok is false if the name is invalid
+func splitTimerPath(p string) (name string, rest string, ok bool) {
+	if !strings.HasPrefix(p, "/w/") {
+		return defaultTimer, p, true
+	}
+
+	split := strings.SplitN(strings.TrimPrefix(p, "/w/"), "/", 2)
+	rest = "/"
+	if len(split) > 1 {
+		rest += split[1]
+	}
+
+	return split[0], rest, timerNameRe.MatchString(split[0])
+}
+
+func (srv *Server) serveStopwatch(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	p := r.URL.Path
+
+	switch {
+	case p == apiV2Prefix || strings.HasPrefix(p, apiV2Prefix+"/"):
+		srv.serveAPIv2(w, withPath(r, strings.TrimPrefix(p, apiV2Prefix)), sw)
+	case p == "/time":
+		srv.handleTime(w, r, sw)
+	case p == "/start":
+		srv.handleStart(w, r, sw)
+	case p == "/stop":
+		srv.handleStop(w, r, sw)
+	case p == "/undo":
+		srv.handleUndo(w, r, sw)
+	case p == "/redo":
+		srv.handleRedo(w, r, sw)
+	case p == "/sessions":
+		srv.handleSessions(w, r, sw)
+	case strings.HasPrefix(p, "/sessions/"):
+		srv.handleSession(w, r, sw)
+	case p == "/stat":
+		srv.handleStat(w, r, sw)
+	case strings.HasPrefix(p, "/export/"):
+		srv.handleExport(w, r, sw)
+	case p == "/import":
+		srv.handleImport(w, r, sw)
+	case strings.HasPrefix(p, "/stats/"):
+		srv.handleDayStat(w, r, sw)
+	case p == "/calendar-url":
+		srv.handleCalendarURL(w, r, sw)
+	case p == "/updates":
+		srv.handleUpdates(w, r, sw, false)
+	case p == "/events":
+		srv.handleEvents(w, r, sw)
+	default:
+		srv.handleIndex(w, r, sw)
+	}
+}
+
+// updated notifies clients of stopwatch about its state change
+func (srv *Server) updated(sw *Stopwatch, eventType string) {
+	srv.hub.Publish(sw, eventType)
+}
+
+// stopwatchPrefix returns URL prefix of stopwatch API and UI pages
+func (srv *Server) stopwatchPrefix(sw *Stopwatch) string {
+	if sw.Name == defaultTimer {
+		return srv.config.HTTP.HrefPrefix
+	}
+
+	return srv.config.HTTP.HrefPrefix + "/w/" + sw.Name
+}
+
+func (srv *Server) templateData(sw *Stopwatch) TemplateData {
+	sw.lock.Lock()
+	day := sw.DayStart
+	sw.lock.Unlock()
+
+	return TemplateData{
+		HrefPrefix:      srv.config.HTTP.HrefPrefix,
+		StopwatchPrefix: srv.stopwatchPrefix(sw),
+		Timer:           sw.Name,
+		DayStart:        millis(day),
+		DayEnd:          millis(dayEnd(day, sw.config)),
+	}
+}
+
+func (srv *Server) handleTime(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	writeResponse(w, sw)
+}
+
+// handleStart starts or switches the stopwatch, project, tags and note
+// are taken from query or form parameters
+func (srv *Server) handleStart(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	err := sw.Start(r.FormValue("project"), parseTags(r.FormValue("tags")), r.FormValue("note"))
+	if err != nil {
+		writeInternalError(w, "failed to start", err)
+		return
+	}
+
+	writeResponse(w, sw)
+	srv.updated(sw, eventStarted)
+}
+
+func (srv *Server) handleStop(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	err := sw.Stop(r.FormValue("note"))
+	if err != nil {
+		writeInternalError(w, "failed to stop", err)
+		return
+	}
+
+	writeResponse(w, sw)
+	srv.updated(sw, eventStopped)
+}
+
+func (srv *Server) handleUndo(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	_, err := sw.Undo()
+	if !writeJournalResponse(w, sw, err) {
+		return
+	}
+
+	srv.updated(sw, eventSessionEdited)
+}
+
+func (srv *Server) handleRedo(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	_, err := sw.Redo()
+	if !writeJournalResponse(w, sw, err) {
+		return
+	}
+
+	srv.updated(sw, eventSessionEdited)
+}
+
+// handleStat serves statistics of a range of dates grouped by periods,
+// see parseStatRequest for parameters
+func (srv *Server) handleStat(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	req, err := parseStatRequest(r.URL.Query(), sw.config, sw.clock.Now(), defaultStatDays)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+		return
+	}
+
+	periods, err := loadPeriodStats(sw.store, sw.config, req)
+	if err != nil {
+		writeInternalError(w, "failed to load stats", err)
+		return
+	}
+
+	response := make([]PeriodStatAPIResponse, len(periods))
+
+	for i, ps := range periods {
+		response[i] = ps.ToAPIResponse()
+	}
+
+	writeJSON(w, response)
+}
+
+var dateRe = regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})`)
+
+func (srv *Server) handleDayStat(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	splitURL := strings.Split(r.URL.Path, "/")
+	if len(splitURL) < 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	matches := dateRe.FindStringSubmatch(splitURL[2])
+	if matches == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	y, _ := strconv.Atoi(matches[1])
+	m, _ := strconv.Atoi(matches[2])
+	s, _ := strconv.Atoi(matches[3])
+
+	from := dateDayStart(time.Date(y, time.Month(m), s, 0, 0, 0, 0, sw.config.Location()), sw.config)
+
+	t, err := template.ParseFiles(path.Join(srv.config.HTTP.StaticDir, "day_stat.html"))
+	if err != nil {
+		log.Printf("failed to parse day stat template file: %s\n", err)
+		return
+	}
+
+	days, err := loadDayStats(sw.store, sw.config, from, dayEnd(from, sw.config))
+
+	if len(days) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := srv.templateData(sw)
+	data.DayStart = millis(from)
+	data.DayEnd = millis(dayEnd(from, sw.config))
+	data.ElapsedTime = formatElapsedTime(days[0].ElapsedTime)
+	data.Projects = days[0].ProjectTotals()
+
+	err = t.Execute(w, data)
+
+	if err != nil {
+		log.Printf("failed to exec template: %s\n", err)
+	}
+}
+
+func (srv *Server) handleIndex(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	t, err := template.ParseFiles(path.Join(srv.config.HTTP.StaticDir, "stopwatch.html"))
+	if err != nil {
+		log.Printf("failed to parse main template file: %s\n", err)
+		return
+	}
+
+	req, err := parseStatRequest(r.URL.Query(), sw.config, sw.clock.Now(), defaultStatDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	days, err := loadDayStats(sw.store, sw.config, req.From, req.To)
+	if err != nil {
+		log.Printf("failed to load day stats: %s\n", err)
+		return
+	}
+
+	data := srv.templateData(sw)
+	data.StatFrom = apiDateFormat(req.From)
+	data.StatTo = req.lastDate()
+	data.Group = req.Group
+
+	if srv.config.Calendar.Secret != "" {
+		data.CalendarURL = srv.calendarURL(r, sw)
+	}
+
+	if req.Group == groupDay {
+		data.Days = days
+	} else {
+		data.Periods = groupDayStats(days, req.Group, sw.config.WeekStart())
+	}
+
+	err = t.Execute(w, data)
+
+	if err != nil {
+		log.Printf("failed to exec template: %s\n", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maximum number of sessions returned by /sessions/search
+const searchLimit = 100
+
+// SessionRequest is a body of POST /sessions and PUT /sessions/{id} requests
+// start and end are Unix timestamps in milliseconds, end = 0 keeps
+// the running session opened. Only start is required
+type SessionRequest struct {
+	Start   int64    `json:"start"`
+	End     int64    `json:"end,omitempty"`
+	Project string   `json:"project,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Note    string   `json:"note,omitempty"`
+}
+
+// SessionPatchRequest is a body of PATCH /sessions/{id} request
+// only fields that are set are changed
+type SessionPatchRequest struct {
+	Start   *int64    `json:"start"`
+	End     *int64    `json:"end"`
+	Project *string   `json:"project"`
+	Tags    *[]string `json:"tags"`
+	Note    *string   `json:"note"`
+}
+
+// apply sets session fields from request
+func (req *SessionRequest) apply(session *Session) {
+	session.Start = millisToTime(req.Start)
+	session.Opened = req.End == 0
+	if !session.Opened {
+		session.End = millisToTime(req.End)
+	}
+	session.Project = req.Project
+	session.Tags = req.Tags
+	session.Note = req.Note
+}
+
+// apply sets session fields that are present in request
+func (req *SessionPatchRequest) apply(session *Session) {
+	if req.Start != nil {
+		session.Start = millisToTime(*req.Start)
+	}
+	if req.End != nil {
+		session.Opened = *req.End == 0
+		if !session.Opened {
+			session.End = millisToTime(*req.End)
+		}
+	}
+	if req.Project != nil {
+		session.Project = *req.Project
+	}
+	if req.Tags != nil {
+		session.Tags = *req.Tags
+	}
+	if req.Note != nil {
+		session.Note = *req.Note
+	}
+}
+
+// handleSessions serves /sessions requests:
+// GET lists sessions of current day or of the day given in time parameter,
+// POST creates a past session
+func (srv *Server) handleSessions(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	switch r.Method {
+	case http.MethodGet:
+		listSessions(w, r, sw)
+	case http.MethodPost:
+		srv.createSession(w, r, sw)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handleSession serves /sessions/search?q= and /sessions/{id} requests
+func (srv *Server) handleSession(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	name := strings.TrimPrefix(r.URL.Path, "/sessions/")
+
+	if name == "search" {
+		if allowMethods(w, r, http.MethodGet) {
+			searchSessions(w, r, sw)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "invalid session id "+name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		session, err := sw.GetSession(id)
+		if !writeSessionError(w, err) {
+			writeJSON(w, session.ToAPIResponse())
+		}
+	case http.MethodPut:
+		req := SessionRequest{}
+		if readJSONRequest(w, r, &req) {
+			srv.editSession(w, r, sw, id, req.apply)
+		}
+	case http.MethodPatch:
+		req := SessionPatchRequest{}
+		if readJSONRequest(w, r, &req) {
+			srv.editSession(w, r, sw, id, req.apply)
+		}
+	case http.MethodDelete:
+		srv.deleteSession(w, r, sw, id)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	ts, ok := r.URL.Query()["time"]
+
+	if !ok {
+		// sessions are copied, as the running one is changed in place
+		sw.lock.Lock()
+		sessions := make([]*Session, 0, len(sw.Sessions)+1)
+		for _, session := range sw.Sessions {
+			sessions = append(sessions, snapshot(session))
+		}
+		if sw.Session != nil {
+			sessions = append(sessions, snapshot(sw.Session))
+		}
+		sw.lock.Unlock()
+
+		writeSessions(w, sessions)
+		return
+	}
+
+	tsInt, err := strconv.ParseInt(ts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "invalid time: "+err.Error())
+		return
+	}
+
+	sessions, err := getAllSessions(sw.store, sw.config, millisToTime(tsInt))
+	if err != nil {
+		writeInternalError(w, "failed to load sessions", err)
+		return
+	}
+
+	writeSessions(w, sessions)
+}
+
+func searchSessions(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	sessions, err := sw.store.SearchSessions(r.URL.Query().Get("q"), searchLimit)
+	if err != nil {
+		writeInternalError(w, "failed to search sessions", err)
+		return
+	}
+
+	writeSessions(w, sessions)
+}
+
+func (srv *Server) createSession(w http.ResponseWriter, r *http.Request, sw *Stopwatch) {
+	req := SessionRequest{}
+	if !readJSONRequest(w, r, &req) {
+		return
+	}
+
+	session := &Session{}
+	req.apply(session)
+
+	err := sw.CreateSession(session)
+	if writeSessionError(w, err) {
+		return
+	}
+
+	writeJSONStatus(w, http.StatusCreated, session.ToAPIResponse())
+	srv.updated(sw, eventSessionEdited)
+}
+
+func (srv *Server) editSession(w http.ResponseWriter, r *http.Request, sw *Stopwatch, id int64, edit func(*Session)) {
+	session, err := sw.EditSession(id, edit)
+	if writeSessionError(w, err) {
+		return
+	}
+
+	writeJSON(w, session.ToAPIResponse())
+	srv.updated(sw, eventSessionEdited)
+}
+
+func (srv *Server) deleteSession(w http.ResponseWriter, r *http.Request, sw *Stopwatch, id int64) {
+	err := sw.DeleteSession(id)
+	if writeSessionError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	srv.updated(sw, eventSessionEdited)
+}
+
+// writeSessionError writes an error response for errors of session editing
+// returns false if there is no error
+func writeSessionError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if err == errSessionNotFound {
+		writeError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+	} else if _, ok := err.(*SessionValidationError); ok {
+		writeError(w, http.StatusUnprocessableEntity, errCodeValidation, err.Error())
+	} else {
+		writeInternalError(w, "failed to save session", err)
+	}
+
+	return true
+}
+
+// readJSONRequest parses request body into v, writes an error response
+// and returns false if the body is not valid
+func readJSONRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "failed to read request body")
+		return false
+	}
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+func writeSessions(w http.ResponseWriter, sessions []*Session) {
+	sessionsAPI := make([]SessionAPIResponse, 0, len(sessions))
+	for _, session := range sessions {
+		sessionsAPI = append(sessionsAPI, session.ToAPIResponse())
+	}
+
+	writeJSON(w, sessionsAPI)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// periods statistics can be grouped by
+const (
+	groupDay   = "day"
+	groupWeek  = "week"
+	groupMonth = "month"
+	groupYear  = "year"
+)
+
+// number of days in statistics by default
+const defaultStatDays = 7
+
+// statRequest is a range of statistics request
+// From is start of the first day, To is end of the last day
+type statRequest struct {
+	From  time.Time
+	To    time.Time
+	Group string
+}
+
+// parseStatRequest parses from, to and group parameters of statistics requests.
+// Dates are in YYYY-MM-DD format and both are included in the range,
+// by default the last days up to today are grouped by day
+func parseStatRequest(query url.Values, cfg *StopwatchConfig, now time.Time, days int) (*statRequest, error) {
+	req := &statRequest{Group: query.Get("group")}
+
+	switch req.Group {
+	case "":
+		req.Group = groupDay
+	case groupDay, groupWeek, groupMonth, groupYear:
+	default:
+		return nil, fmt.Errorf("invalid group %s, must be one of day, week, month, year", req.Group)
+	}
+
+	last := dayStart(now, cfg)
+	if query.Get("to") != "" {
+		date, err := time.ParseInLocation("2006-01-02", query.Get("to"), cfg.Location())
+		if err != nil {
+			return nil, fmt.Errorf("invalid to date: %s", query.Get("to"))
+		}
+		last = dateDayStart(date, cfg)
+	}
+
+	y, m, d := last.Date()
+	req.From = dateDayStart(time.Date(y, m, d-days+1, 0, 0, 0, 0, last.Location()), cfg)
+	if query.Get("from") != "" {
+		date, err := time.ParseInLocation("2006-01-02", query.Get("from"), cfg.Location())
+		if err != nil {
+			return nil, fmt.Errorf("invalid from date: %s", query.Get("from"))
+		}
+		req.From = dateDayStart(date, cfg)
+	}
+
+	if req.From.After(last) {
+		return nil, fmt.Errorf("from date is after to date")
+	}
+
+	req.To = dayEnd(last, cfg)
+	return req, nil
+}
+
+// lastDate returns formatted last date of the range
+func (req *statRequest) lastDate() string {
+	return apiDateFormat(req.To.Add(-time.Nanosecond))
+}
+
+// PeriodStat is a total time of a period: a day, a week, a month or a year.
+// From and To are starts of the first and the last days of period that are in requested range
+// ElapsedTime is duration in milliseconds
+// Projects holds durations in milliseconds per project
+type PeriodStat struct {
+	From        time.Time
+	To          time.Time
+	ElapsedTime int64
+	Projects    map[string]int64
+}
+
+// FromDate returns formatted first date of period for ui
+func (ps PeriodStat) FromDate() string {
+	return apiDateFormat(ps.From)
+}
+
+// ToDate returns formatted last date of period for ui
+func (ps PeriodStat) ToDate() string {
+	return apiDateFormat(ps.To)
+}
+
+// FormatElapsedTime returns formatted time for ui
+func (ps PeriodStat) FormatElapsedTime() string {
+	return formatElapsedTime(ps.ElapsedTime)
+}
+
+// ProjectTotals returns per-project totals ordered by project name
+func (ps PeriodStat) ProjectTotals() []ProjectTotal {
+	return projectTotals(ps.Projects)
+}
+
+// ToAPIResponse converts PeriodStat instance to API response
+func (ps PeriodStat) ToAPIResponse() PeriodStatAPIResponse {
+	projects := ps.Projects
+	if projects == nil {
+		projects = map[string]int64{}
+	}
+
+	return PeriodStatAPIResponse{
+		Date:     ps.FromDate(),
+		From:     ps.FromDate(),
+		To:       ps.ToDate(),
+		Time:     ps.ElapsedTime,
+		Projects: projects,
+	}
+}
+
+// PeriodStatAPIResponse is PeriodStat representation in JSON
+// Date is the first date of period, same as From, it's kept for clients of day statistics
+// From and To are the first and the last dates of period
+// Time is duration in milliseconds
+// Projects are durations in milliseconds per project
+type PeriodStatAPIResponse struct {
+	Date     string           `json:"date"`
+	From     string           `json:"from"`
+	To       string           `json:"to"`
+	Time     int64            `json:"time"`
+	Projects map[string]int64 `json:"projects"`
+}
+
+// periodStart returns the first date of period containing the date
+func periodStart(date time.Time, group string, weekStart time.Weekday) time.Time {
+	y, m, d := date.Date()
+
+	switch group {
+	case groupWeek:
+		offset := (int(date.Weekday()) - int(weekStart) + 7) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, date.Location())
+	case groupMonth:
+		return time.Date(y, m, 1, 0, 0, 0, 0, date.Location())
+	case groupYear:
+		return time.Date(y, time.January, 1, 0, 0, 0, 0, date.Location())
+	}
+
+	return time.Date(y, m, d, 0, 0, 0, 0, date.Location())
+}
+
+// groupDayStats sums up day statistics by periods, days must be ordered by time
+func groupDayStats(days []DayStat, group string, weekStart time.Weekday) []PeriodStat {
+	var periods []PeriodStat
+	var current time.Time
+
+	for _, day := range days {
+		start := periodStart(day.StartTime, group, weekStart)
+		if len(periods) == 0 || !start.Equal(current) {
+			current = start
+			periods = append(periods, PeriodStat{
+				From:     day.StartTime,
+				Projects: make(map[string]int64),
+			})
+		}
+
+		period := &periods[len(periods)-1]
+		period.To = day.StartTime
+		period.ElapsedTime += day.ElapsedTime
+		for project, elapsed := range day.Projects {
+			period.Projects[project] += elapsed
+		}
+	}
+
+	return periods
+}
+
+// loadPeriodStats returns statistics of requested range grouped by periods
+func loadPeriodStats(store Store, cfg *StopwatchConfig, req *statRequest) ([]PeriodStat, error) {
+	days, err := loadDayStats(store, cfg, req.From, req.To)
+	if err != nil {
+		return nil, err
+	}
+
+	return groupDayStats(days, req.Group, cfg.WeekStart()), nil
+}
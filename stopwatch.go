@@ -1,8 +1,7 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,55 +11,63 @@ import (
 )
 
 // Stopwatch is the main type of stopwatch app.
-// An instance of this type is created when the app starts.
+// An instance of this type is created for every named stopwatch.
 // Structure holds all sessions for current day and start of the day.
 type Stopwatch struct {
+	Name          string
 	ElapsedTime   int64      // total ms for previous sessions
 	Sessions      []*Session // closed sessions
 	Session       *Session
-	db            *sql.DB
+	store         Store
 	DayStart      time.Time
 	config        *StopwatchConfig
 	lock          sync.Mutex
 	notifications chan Notification
+	clock         Clock
+
+	// start of the first part of the running session, cached by its ID
+	originID    int64
+	originStart time.Time
 }
 
-// NewStopwatch creates and initializes a Stopwatch instance
-// It opens log file, opens a database and loads sessions for current day
-func NewStopwatch(cfg *Config) (*Stopwatch, error) {
-	if cfg.Stopwatch.Log != "" {
-		var logfd *os.File
-		if _, err := os.Stat(cfg.Stopwatch.Log); os.IsNotExist(err) {
-			logfd, err = os.Create(cfg.Stopwatch.Log)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create log file: %s\n", err)
+// openLog redirects log to the file set in config, if any
+func openLog(cfg *StopwatchConfig) error {
+	if cfg.Log == "" {
+		return nil
+	}
 
-			}
-		} else {
-			logfd, err = os.OpenFile(cfg.Stopwatch.Log, os.O_APPEND|os.O_WRONLY, 0600)
-			if err != nil {
-				return nil, fmt.Errorf("failed to open log file: %s\n", err)
-			}
+	var logfd *os.File
+	if _, err := os.Stat(cfg.Log); os.IsNotExist(err) {
+		logfd, err = os.Create(cfg.Log)
+		if err != nil {
+			return fmt.Errorf("failed to create log file: %s", err)
+		}
+	} else {
+		logfd, err = os.OpenFile(cfg.Log, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %s", err)
 		}
-		log.SetOutput(logfd)
 	}
+	log.SetOutput(logfd)
 
-	db, err := openDB(cfg.DB)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open db connection: %s\n", err)
-	}
+	return nil
+}
 
+// NewStopwatch creates and initializes a named Stopwatch instance
+// It loads sessions for current day from the store, the store must
+// be limited to the sessions of this stopwatch.
+// notifications channel is nil if notifications are disabled
+func NewStopwatch(name string, store Store, cfg *StopwatchConfig, notifications chan Notification, clock Clock) (*Stopwatch, error) {
 	sw := &Stopwatch{
-		db:       db,
-		DayStart: time.Now(),
-		config:   cfg.Stopwatch,
+		Name:          name,
+		store:         store,
+		DayStart:      dayStart(clock.Now(), cfg),
+		config:        cfg,
+		notifications: notifications,
+		clock:         clock,
 	}
 
-	if cfg.Stopwatch.DisplayNotifications {
-		sw.notifications = make(chan Notification)
-	}
-
-	err = sw.LoadSessions()
+	err := sw.LoadSessions()
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to load sessions: %s", err)
@@ -69,15 +76,18 @@ func NewStopwatch(cfg *Config) (*Stopwatch, error) {
 	return sw, nil
 }
 
-// LoadSessions gets sessions for current day from db,
-// populates s.Sessions slice and sets s.ElapsedTime
+// LoadSessions gets sessions for current day from the store,
+// populates s.Sessions slice, s.Session and sets s.ElapsedTime
 func (s *Stopwatch) LoadSessions() error {
-	sessions, err := getAllSessions(s.db, s.config, s.DayStart)
+	sessions, err := getAllSessions(s.store, s.config, s.DayStart)
 
 	if err != nil {
 		return fmt.Errorf("get sessions: %s", err)
 	}
 
+	s.ElapsedTime = 0
+	s.Session = nil
+
 	for _, session := range sessions {
 		if !session.Opened {
 			s.ElapsedTime += session.Duration()
@@ -97,133 +107,481 @@ func (s *Stopwatch) LoadSessions() error {
 	return nil
 }
 
-// Start starts stopwatch by opening a new session
-func (s *Stopwatch) Start() error {
+// Start starts stopwatch by opening a new session with given project, tags and note.
+// If stopwatch is already running on another project or with other tags,
+// current session is closed and a new one is opened at the same moment.
+// If it's running on the same project, only a non-empty note is saved
+func (s *Stopwatch) Start(project string, tags []string, note string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if s.Session == nil {
-		s.Session = NewSession()
+	if s.Session != nil && s.Session.SameProject(project, tags) {
+		if note == "" || note == s.Session.Note {
+			return nil
+		}
+
+		before := snapshot(s.Session)
+		s.Session.Note = note
 
-		err := s.Session.SaveOpened(s.db)
+		err := s.store.UpdateSession(s.Session)
 		if err != nil {
 			return err
 		}
 
-		if s.notifications != nil {
-			s.notifications <- Notification{
-				Title: "Stopwatch started",
-				Text:  formatElapsedTime(s.ElapsedTime),
-			}
+		s.record(actionNote, SessionChange{Before: before, After: snapshot(s.Session)})
+		return nil
+	}
+
+	start := s.clock.Now()
+	switching := s.Session != nil
+	var changes []SessionChange
+
+	if switching {
+		change, err := s.closeSession()
+		if err != nil {
+			return err
 		}
+		start = change.After.End
+		changes = append(changes, change)
 	}
 
+	session := NewSession(start, project, tags, note)
+
+	err := session.SaveOpened(s.store)
+	if err != nil {
+		return err
+	}
+	s.Session = session
+
+	if switching {
+		s.record(actionSwitch, append(changes, SessionChange{After: snapshot(session)})...)
+	} else {
+		s.record(actionStart, SessionChange{After: snapshot(session)})
+	}
+
+	title := "Stopwatch started"
+	if switching {
+		title = "Stopwatch switched"
+	}
+	if project != "" {
+		title += ": " + project
+	}
+	s.notify(title)
+
 	return nil
 }
 
 // Stop stops stopwatch by closing current session
-// and adds current session's duration to s.ElapsedTime
-func (s *Stopwatch) Stop() error {
+// and adds current session's duration to s.ElapsedTime.
+// Non-empty note replaces the note of closed session
+func (s *Stopwatch) Stop(note string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	if s.Session != nil {
-		session := s.Session
-		session.Close()
+		if note != "" {
+			s.Session.Note = note
+		}
 
-		err := session.SaveClosed(s.db)
+		change, err := s.closeSession()
 		if err != nil {
 			return err
 		}
 
-		s.Sessions = append(s.Sessions, session)
-		s.Session = nil
-		s.ElapsedTime += session.Duration()
+		s.record(actionStop, change)
+
+		s.notify("Stopwatch stopped")
+	}
+
+	return nil
+}
+
+// notify sends a notification with elapsed time if notifications are enabled,
+// name of a non-default stopwatch is added to title. s.lock must be held by caller
+func (s *Stopwatch) notify(title string) {
+	if s.notifications == nil {
+		return
+	}
+
+	if s.Name != defaultTimer {
+		title = "[" + s.Name + "] " + title
+	}
+
+	s.notifications <- Notification{
+		Title: title,
+		Text:  formatElapsedTime(s.ElapsedTime),
+	}
+}
+
+// closeSession closes and saves current session, moves it to closed sessions.
+// Returns the change of session for journal. s.lock must be held by caller
+func (s *Stopwatch) closeSession() (SessionChange, error) {
+	session := s.Session
+	before := snapshot(session)
+	session.Close(s.clock.Now())
+
+	err := session.SaveClosed(s.store)
+	if err != nil {
+		return SessionChange{}, err
+	}
+
+	s.Sessions = append(s.Sessions, session)
+	s.Session = nil
+	s.ElapsedTime += session.Duration()
+
+	return SessionChange{Before: before, After: snapshot(session)}, nil
+}
+
+// errSessionNotFound is returned when editing a session that does not exist
+var errSessionNotFound = errors.New("session not found")
+
+// SessionValidationError is returned when a created or edited
+// session is invalid, e.g. overlaps with other sessions
+type SessionValidationError struct {
+	Message string
+}
+
+func (e *SessionValidationError) Error() string {
+	return e.Message
+}
+
+// CreateSession saves a manually created closed session and reloads current day
+func (s *Stopwatch) CreateSession(session *Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if session.Opened {
+		return &SessionValidationError{"session must have an end"}
+	}
+
+	err := s.validateSession(session)
+	if err != nil {
+		return err
+	}
+
+	err = s.store.InsertSession(session)
+	if err != nil {
+		return err
+	}
+
+	s.record(actionCreate, SessionChange{After: snapshot(session)})
+	return s.LoadSessions()
+}
+
+// EditSession applies edit function to a session by ID, validates
+// and saves the result, then reloads current day.
+// Only the currently running session may stay opened after the edit
+func (s *Stopwatch) EditSession(id int64, edit func(session *Session)) (*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	found, err := s.findSession(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if found == nil {
+		return nil, errSessionNotFound
+	}
+
+	session := *found
+	edit(&session)
+	session.ID = id
+
+	if session.Opened && (s.Session == nil || s.Session.ID != id) {
+		return nil, &SessionValidationError{"only the running session can be opened"}
+	}
+
+	err = s.validateSession(&session)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.UpdateSession(&session)
+	if err != nil {
+		return nil, err
+	}
+
+	s.record(actionEdit, SessionChange{Before: snapshot(found), After: snapshot(&session)})
+	return &session, s.LoadSessions()
+}
+
+// GetSession returns a copy of a session by ID
+func (s *Stopwatch) GetSession(id int64) (*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	found, err := s.findSession(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if found == nil {
+		return nil, errSessionNotFound
+	}
+
+	return snapshot(found), nil
+}
 
-		if s.notifications != nil {
-			s.notifications <- Notification{
-				Title: "Stopwatch stopped",
-				Text:  formatElapsedTime(s.ElapsedTime),
-			}
+// DeleteSession deletes a session by ID and reloads current day,
+// deleting the running session stops stopwatch
+func (s *Stopwatch) DeleteSession(id int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	found, err := s.findSession(id)
+	if err != nil {
+		return err
+	}
+
+	if found == nil {
+		return errSessionNotFound
+	}
+
+	err = s.store.DeleteSession(id)
+	if err != nil {
+		return err
+	}
+
+	s.record(actionDelete, SessionChange{Before: snapshot(found)})
+	return s.LoadSessions()
+}
+
+// validateSession checks that session ends after its start, is not in the future
+// and does not overlap with other sessions. s.lock must be held by caller
+func (s *Stopwatch) validateSession(session *Session) error {
+	now := s.clock.Now()
+	end := session.End
+	if session.Opened {
+		end = now
+	}
+
+	if !session.Start.Before(end) {
+		return &SessionValidationError{"session must end after its start"}
+	}
+
+	if end.After(now) {
+		return &SessionValidationError{"session can not end in the future"}
+	}
+
+	overlapping, err := s.store.OverlappingSessions(session.Start, end)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range overlapping {
+		if other.ID != session.ID {
+			return &SessionValidationError{fmt.Sprintf("session overlaps with session %d", other.ID)}
 		}
 	}
 
 	return nil
 }
 
+// findSession returns a session by ID, sessions of current day are
+// taken from memory so that changes are visible in stopwatch state.
+// s.lock must be held by caller
+func (s *Stopwatch) findSession(id int64) (*Session, error) {
+	if s.Session != nil && s.Session.ID == id {
+		return s.Session, nil
+	}
+
+	for _, session := range s.Sessions {
+		if session.ID == id {
+			return session, nil
+		}
+	}
+
+	return s.store.GetSession(id)
+}
+
 // APIResponse is returned in /time, /start and /stop handlers
+// DayStart and DayEnd are bounds of current day, Unix timestamps in milliseconds.
+// Project and Tags are set for running stopwatch only
 type APIResponse struct {
-	Time    int64  `json:"time"`
-	Running bool   `json:"running"`
-	Date    string `json:"date"`
+	Time     int64    `json:"time"`
+	Running  bool     `json:"running"`
+	Date     string   `json:"date"`
+	DayStart int64    `json:"day_start"`
+	DayEnd   int64    `json:"day_end"`
+	Project  string   `json:"project,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
 }
 
-// GetAPIResponse makes an APIResponse structure for current stopwatch instance
+// GetAPIResponse makes an APIResponse structure for current stopwatch instance.
+// s.lock must be held by caller
 func (s *Stopwatch) GetAPIResponse() *APIResponse {
 	total := int64(0)
 	if s.Session != nil {
-		total = s.ElapsedTime + time.Since(s.Session.Start).Nanoseconds()/1000000
+		total = s.ElapsedTime + millis(s.clock.Now()) - millis(s.Session.Start)
 	} else {
 		total = s.ElapsedTime
 	}
 
-	return &APIResponse{
-		Time:    total,
-		Running: s.Session != nil,
-		Date:    apiDateFormat(s.DayStart),
+	resp := &APIResponse{
+		Time:     total,
+		Running:  s.Session != nil,
+		Date:     apiDateFormat(s.DayStart),
+		DayStart: millis(s.DayStart),
+		DayEnd:   millis(dayEnd(s.DayStart, s.config)),
 	}
+
+	if s.Session != nil {
+		resp.Project = s.Session.Project
+		resp.Tags = s.Session.Tags
+	}
+
+	return resp
 }
 
-func writeResponse(w http.ResponseWriter, sw *Stopwatch) error {
+// writeResponse writes current state of stopwatch
+func writeResponse(w http.ResponseWriter, sw *Stopwatch) {
+	sw.lock.Lock()
 	resp := sw.GetAPIResponse()
+	sw.lock.Unlock()
 
-	data, err := json.Marshal(resp)
+	writeJSON(w, resp)
+}
 
-	if err != nil {
-		return err
+// interval of checks of day end between scheduled rollovers,
+// they catch system sleep and wall clock changes. Larger difference
+// of wall and monotonic time between checks is logged as a clock jump
+const (
+	rolloverCheckInterval = time.Minute
+	clockJumpTolerance    = 5 * time.Second
+)
+
+// capDeadline returns the time when the running session reaches
+// max session length, zero time if there is no limit or running session.
+// s.lock must be held by caller
+func (s *Stopwatch) capDeadline() time.Time {
+	maxLength := s.config.MaxSessionLength()
+	if maxLength == 0 || s.Session == nil {
+		return time.Time{}
+	}
+
+	if s.originID != s.Session.ID {
+		origin, _, err := sessionOrigin(s.store, s.Session)
+		if err != nil {
+			log.Printf("failed to find start of session %d: %s\n", s.Session.ID, err)
+			return time.Time{}
+		}
+
+		s.originID = s.Session.ID
+		s.originStart = origin
 	}
 
-	_, err = w.Write(data)
+	return s.originStart.Add(maxLength)
+}
+
+// rollOver moves stopwatch to the day of now if its day has ended.
+// The running session is repaired by splitLastSession when the day ends,
+// when it reaches max session length or if force is set. Force is used
+// on startup, when an opened session of a previous day is not among
+// loaded sessions, and after wall clock jumps.
+// The repair is returned if it was needed. Returns true if the day of
+// stopwatch changed, a repair may be made without it, e.g. when the
+// running session is capped in the middle of the day.
+// Repairs are not journaled, undo can't bring back a session they split or capped
+func (s *Stopwatch) rollOver(now time.Time, force bool) (bool, *sessionRepair, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.rollOverLocked(now, force)
+}
+
+// rollOverLocked is rollOver for callers holding s.lock
+func (s *Stopwatch) rollOverLocked(now time.Time, force bool) (bool, *sessionRepair, error) {
+	day := dayStart(now, s.config)
+	dayEnded := day.After(dayStart(s.DayStart, s.config))
+
+	capAt := s.capDeadline()
+	capReached := !capAt.IsZero() && !now.Before(capAt)
+
+	if !dayEnded && !capReached && !force {
+		return false, nil, nil
+	}
 
+	repair, err := splitLastSession(s.store, s.config, now)
 	if err != nil {
-		return err
+		return false, nil, fmt.Errorf("split last session: %s", err)
 	}
 
-	return nil
+	if !dayEnded && repair == nil {
+		return false, nil, nil
+	}
+
+	// day start doesn't move back when wall clock jumps backwards
+	if dayEnded {
+		s.DayStart = day
+	}
+
+	return dayEnded, repair, s.LoadSessions()
 }
 
-// DaySplitWorker is a background worker that renews
-// sessions slice of a Stopwatch instance when day ends
-// if there is an open session in the end of day then it's split
-// into two, first part is closed on the end of the day and
-// the second part is starting at the same time
-func DaySplitWorker(sw *Stopwatch, updates chan<- bool) {
-	nextDayEnd := dayEnd(time.Now(), sw.config.DayStartHour)
+// DaySplitWorker is a background worker that rolls stopwatch over
+// to the next day when the day ends, see Stopwatch.rollOver.
+// It sleeps until the day end or until the running session reaches
+// max session length, but wakes up at least every rolloverCheckInterval,
+// as timers don't count time of system sleep and don't notice wall
+// clock changes. Checks between the deadlines don't touch the store.
+// When stop is closed the worker drops events of the stopwatch from hub and returns,
+// it's the only one publishing events of an idle stopwatch
+func DaySplitWorker(sw *Stopwatch, hub *Hub, stop <-chan struct{}) {
+	logPrefix := "[split-worker]"
 
 	for {
-		time.Sleep(time.Minute)
-
-		if time.Now().After(nextDayEnd) {
-			log.Printf("[split-worker] day ended")
-			sw.lock.Lock()
-			newSession, err := splitLastSession(sw.db, sw.config)
-			if err != nil {
-				log.Printf("[split-worker] failed to split last session: %s\n", err)
-				sw.lock.Unlock()
-				continue
-			}
-
-			sw.DayStart = dayStart(time.Now(), sw.config.DayStartHour)
-			sw.Session = newSession
-			sw.ElapsedTime = 0
-			err = sw.LoadSessions()
-			sw.lock.Unlock()
-			if err != nil {
-				log.Printf("[split-worker] failed to load sessions: %s\n", err)
-				continue
-			}
-			nextDayEnd = dayEnd(time.Now(), sw.config.DayStartHour)
-			updates <- true
+		now := sw.clock.Now()
+		elapsed := sw.clock.Elapsed()
+		wait := dayEnd(now, sw.config).Sub(now)
+		if wait > rolloverCheckInterval {
+			wait = rolloverCheckInterval
+		}
+
+		sw.lock.Lock()
+		capAt := sw.capDeadline()
+		sw.lock.Unlock()
+
+		// a deadline in the past is due to a failed repair,
+		// it's retried on the next regular check
+		if capAt.After(now) && capAt.Sub(now) < wait {
+			wait = capAt.Sub(now)
+		}
+
+		select {
+		case <-sw.clock.After(wait):
+		case <-stop:
+			hub.Remove(sw)
+			return
+		}
+
+		woke := sw.clock.Now()
+
+		// Round(0) strips monotonic reading, so the first difference is of wall time
+		jump := woke.Round(0).Sub(now.Round(0)) - (sw.clock.Elapsed() - elapsed)
+		jumped := jump > clockJumpTolerance || jump < -clockJumpTolerance
+		if jumped {
+			log.Printf("%s wall clock jumped by %s\n", logPrefix, jump)
+		}
+
+		rolled, repair, err := sw.rollOver(woke, jumped)
+		if err != nil {
+			log.Printf("%s failed to roll over stopwatch %s: %s\n", logPrefix, sw.Name, err)
+			continue
+		}
+
+		if repair != nil {
+			log.Printf("%s stopwatch %s: %s\n", logPrefix, sw.Name, repair)
+		}
+
+		switch {
+		case rolled:
+			log.Printf("%s day ended", logPrefix)
+			hub.Publish(sw, eventDayRolledOver)
+		case repair != nil && (repair.Capped || repair.Discarded):
+			hub.Publish(sw, eventStopped)
+		case repair != nil:
+			hub.Publish(sw, eventSessionEdited)
 		}
 	}
 }
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Monday, days start at 08:00 in test config
+var testMonday = time.Date(2024, 5, 6, 0, 0, 0, 0, time.Local)
+
+func at(day int, hour int, min int) time.Time {
+	return testMonday.AddDate(0, 0, day).Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute)
+}
+
+// newTestServer creates a multi-user server with memory store,
+// stopwatches are loaded on first Stopwatch call
+func newTestServer(t *testing.T, clock Clock, configure func(cfg *Config)) *Server {
+	cfg := NewConfig()
+	cfg.DB.Driver = driverMemory
+	cfg.HTTP.MultiUser = true
+
+	if configure != nil {
+		configure(cfg)
+	}
+
+	srv, err := NewServer(cfg, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return srv
+}
+
+var testScope = Scope{UserID: 1, Timer: defaultTimer}
+
+func testStopwatch(t *testing.T, srv *Server) *Stopwatch {
+	sw, err := srv.Stopwatch(testScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sw
+}
+
+func allSessions(t *testing.T, srv *Server) []*Session {
+	sessions, err := srv.store.WithScope(testScope).OverlappingSessions(time.Time{}, at(365, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sessions
+}
+
+type span struct {
+	start time.Time
+	end   time.Time // zero for opened session
+}
+
+func checkSessions(t *testing.T, srv *Server, expected ...span) {
+	t.Helper()
+
+	sessions := allSessions(t, srv)
+	if len(sessions) != len(expected) {
+		t.Fatalf("%d sessions, expected %d: %v", len(sessions), len(expected), sessions)
+	}
+
+	for i, s := range sessions {
+		opened := expected[i].end.IsZero()
+		if !s.Start.Equal(expected[i].start) || s.Opened != opened || (!opened && !s.End.Equal(expected[i].end)) {
+			t.Errorf("session %d is %s - %s (opened %v), expected %s - %s", i, s.Start, s.End, s.Opened, expected[i].start, expected[i].end)
+		}
+	}
+}
+
+// waitSleeping waits until day split worker sleeps on the clock
+func waitSleeping(t *testing.T, clock *FakeClock) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for clock.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("worker doesn't sleep")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func checkDayStart(t *testing.T, sw *Stopwatch, expected time.Time) {
+	t.Helper()
+
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	if !sw.DayStart.Equal(expected) {
+		t.Errorf("day start is %s, expected %s", sw.DayStart, expected)
+	}
+}
+
+// waitEvent waits for an event of given type skipping other events
+func waitEvent(t *testing.T, sub *Subscriber, eventType string) *Event {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case <-sub.Ready():
+			for _, ev := range sub.Take() {
+				if ev.Type == eventType {
+					return ev
+				}
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", eventType)
+		}
+	}
+}
+
+func TestRollOverAtDayEnd(t *testing.T) {
+	clock := NewFakeClock(at(0, 23, 0))
+	srv := newTestServer(t, clock, nil)
+	sw := testStopwatch(t, srv)
+
+	err := sw.Start("work", []string{"a"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := srv.hub.Subscribe(sw, -1)
+	defer srv.hub.Unsubscribe(sub)
+
+	// the worker wakes every minute, the last wake is exactly at day end
+	for clock.Now().Before(at(1, 8, 0)) {
+		waitSleeping(t, clock)
+		clock.Advance(time.Minute)
+	}
+
+	ev := waitEvent(t, sub, eventDayRolledOver)
+	if ev.Data.Date != apiDateFormat(at(1, 8, 0)) || !ev.Data.Running || ev.Data.Project != "work" {
+		t.Errorf("unexpected state after rollover: %+v", ev.Data)
+	}
+
+	checkDayStart(t, sw, at(1, 8, 0))
+	checkSessions(t, srv,
+		span{at(0, 23, 0), at(1, 8, 0)},
+		span{at(1, 8, 0), time.Time{}},
+	)
+
+	// the split is not journaled
+	action, err := sw.store.LastAction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if action == nil || action.Kind != actionStart {
+		t.Errorf("last action is %+v", action)
+	}
+}
+
+func TestRestartAfterSeveralDays(t *testing.T) {
+	clock := NewFakeClock(at(3, 10, 0))
+	srv := newTestServer(t, clock, nil)
+
+	// session was opened on monday before the server went down
+	err := NewSession(at(0, 9, 0), "work", []string{"a"}, "").SaveOpened(srv.store.WithScope(testScope))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sw := testStopwatch(t, srv)
+
+	checkDayStart(t, sw, at(3, 8, 0))
+	checkSessions(t, srv,
+		span{at(0, 9, 0), at(1, 8, 0)},
+		span{at(1, 8, 0), at(2, 8, 0)},
+		span{at(2, 8, 0), at(3, 8, 0)},
+		span{at(3, 8, 0), time.Time{}},
+	)
+
+	for _, s := range allSessions(t, srv) {
+		if s.Project != "work" || len(s.Tags) != 1 || s.Tags[0] != "a" {
+			t.Errorf("part %s has project %q and tags %v", s.Start, s.Project, s.Tags)
+		}
+	}
+
+	sw.lock.Lock()
+	elapsed := sw.GetAPIResponse().Time
+	sw.lock.Unlock()
+
+	if elapsed != int64(2*time.Hour/time.Millisecond) {
+		t.Errorf("elapsed time is %d", elapsed)
+	}
+}
+
+func TestRestartCapsForgottenSession(t *testing.T) {
+	for _, mode := range []string{longSessionsCap, longSessionsDiscard} {
+		t.Run(mode, func(t *testing.T) {
+			clock := NewFakeClock(at(3, 10, 0))
+			srv := newTestServer(t, clock, func(cfg *Config) {
+				cfg.Stopwatch.MaxSessionHours = 30
+				cfg.Stopwatch.LongSessions = mode
+			})
+
+			err := NewSession(at(0, 9, 0), "work", nil, "").SaveOpened(srv.store.WithScope(testScope))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sw := testStopwatch(t, srv)
+			checkDayStart(t, sw, at(3, 8, 0))
+
+			// limit is counted from monday 09:00, not from start of the last part
+			if mode == longSessionsCap {
+				checkSessions(t, srv,
+					span{at(0, 9, 0), at(1, 8, 0)},
+					span{at(1, 8, 0), at(1, 15, 0)},
+				)
+			} else {
+				checkSessions(t, srv)
+			}
+		})
+	}
+}
+
+func TestRestartCapsSplitSession(t *testing.T) {
+	for _, mode := range []string{longSessionsCap, longSessionsDiscard} {
+		t.Run(mode, func(t *testing.T) {
+			clock := NewFakeClock(at(3, 10, 0))
+			srv := newTestServer(t, clock, func(cfg *Config) {
+				cfg.Stopwatch.MaxSessionHours = 30
+				cfg.Stopwatch.LongSessions = mode
+			})
+
+			// the session was split at tuesday start by the running server
+			store := srv.store.WithScope(testScope)
+			first := NewSession(at(0, 9, 0), "work", nil, "")
+			first.Close(at(1, 8, 0))
+			err := store.InsertSession(first)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = NewSession(at(1, 8, 0), "work", nil, "").SaveOpened(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			testStopwatch(t, srv)
+
+			if mode == longSessionsCap {
+				checkSessions(t, srv,
+					span{at(0, 9, 0), at(1, 8, 0)},
+					span{at(1, 8, 0), at(1, 15, 0)},
+				)
+			} else {
+				checkSessions(t, srv)
+			}
+		})
+	}
+}
+
+func TestWorkerCapsSessionAtDeadline(t *testing.T) {
+	clock := NewFakeClock(at(0, 9, 0))
+	srv := newTestServer(t, clock, func(cfg *Config) {
+		cfg.Stopwatch.MaxSessionHours = 2
+	})
+	sw := testStopwatch(t, srv)
+
+	err := sw.Start("work", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := srv.hub.Subscribe(sw, -1)
+	defer srv.hub.Unsubscribe(sub)
+
+	for clock.Now().Before(at(0, 11, 0)) {
+		waitSleeping(t, clock)
+		clock.Advance(40 * time.Second)
+	}
+	waitSleeping(t, clock)
+
+	// the cap is in the middle of the day, the day doesn't change
+	ev := waitEvent(t, sub, eventStopped)
+	if ev.Data.Running || ev.Data.Time != int64(2*time.Hour/time.Millisecond) {
+		t.Errorf("unexpected state after cap: %+v", ev.Data)
+	}
+
+	for _, ev := range sub.Take() {
+		if ev.Type == eventDayRolledOver {
+			t.Error("day is rolled over by cap")
+		}
+	}
+
+	checkDayStart(t, sw, at(0, 8, 0))
+	checkSessions(t, srv, span{at(0, 9, 0), at(0, 11, 0)})
+}
+
+func TestLongSessionIsSplitEveryDay(t *testing.T) {
+	clock := NewFakeClock(at(0, 10, 0))
+	srv := newTestServer(t, clock, nil)
+	sw := testStopwatch(t, srv)
+
+	err := sw.Start("work", []string{"a"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the worker wakes at day ends and every minute, a sleeping
+	// worker wakes once however far the clock is advanced
+	for clock.Now().Before(at(3, 9, 0)) {
+		waitSleeping(t, clock)
+		clock.Advance(time.Hour)
+	}
+	waitSleeping(t, clock)
+
+	checkSessions(t, srv,
+		span{at(0, 10, 0), at(1, 8, 0)},
+		span{at(1, 8, 0), at(2, 8, 0)},
+		span{at(2, 8, 0), at(3, 8, 0)},
+		span{at(3, 8, 0), time.Time{}},
+	)
+
+	for _, s := range allSessions(t, srv) {
+		if s.Project != "work" || len(s.Tags) != 1 || s.Tags[0] != "a" {
+			t.Errorf("part %s has project %q and tags %v", s.Start, s.Project, s.Tags)
+		}
+	}
+
+	sw.lock.Lock()
+	elapsed := sw.GetAPIResponse().Time
+	sw.lock.Unlock()
+
+	if elapsed != int64(time.Hour/time.Millisecond) {
+		t.Errorf("elapsed time is %d", elapsed)
+	}
+}
+
+func TestStoppedSessionIsNotSplit(t *testing.T) {
+	clock := NewFakeClock(at(0, 22, 0))
+	srv := newTestServer(t, clock, nil)
+	sw := testStopwatch(t, srv)
+
+	err := sw.Start("work", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	err = sw.Stop("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := srv.hub.Subscribe(sw, -1)
+	defer srv.hub.Unsubscribe(sub)
+
+	for !clock.Now().After(at(1, 8, 0)) {
+		waitSleeping(t, clock)
+		clock.Advance(time.Hour)
+	}
+
+	ev := waitEvent(t, sub, eventDayRolledOver)
+	if ev.Data.Running || ev.Data.Time != 0 {
+		t.Errorf("unexpected state after rollover: %+v", ev.Data)
+	}
+
+	checkSessions(t, srv, span{at(0, 22, 0), at(0, 23, 0)})
+}
+
+func TestUndoDoesNotReopenPreviousDay(t *testing.T) {
+	clock := NewFakeClock(at(0, 22, 0))
+	srv := newTestServer(t, clock, nil)
+	sw := testStopwatch(t, srv)
+
+	err := sw.Start("work", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	err = sw.Stop("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for !clock.Now().After(at(1, 8, 0)) {
+		waitSleeping(t, clock)
+		clock.Advance(time.Hour)
+	}
+	waitSleeping(t, clock)
+	checkDayStart(t, sw, at(1, 8, 0))
+
+	_, err = sw.Undo()
+	if err != errReopenPreviousDay {
+		t.Errorf("undo of stop of the previous day returned %v", err)
+	}
+
+	checkSessions(t, srv, span{at(0, 22, 0), at(0, 23, 0)})
+}
+
+func TestIdleStopwatchesAreUnloaded(t *testing.T) {
+	clock := NewFakeClock(at(0, 12, 0))
+	srv := newTestServer(t, clock, func(cfg *Config) {
+		cfg.HTTP.MaxStopwatches = 2
+	})
+
+	load := func(name string) (*Stopwatch, error) {
+		return srv.Stopwatch(Scope{UserID: 1, Timer: name})
+	}
+
+	work, err := load("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = work.Start("work", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.hub.Publish(work, eventStarted)
+
+	study, err := load("study")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := srv.hub.Subscribe(study, -1)
+
+	_, err = load("client")
+	if err != errTooManyStopwatches {
+		t.Fatalf("stopwatch over the limit is loaded while others are in use, error %v", err)
+	}
+
+	// work is idle, study has a subscriber
+	clock.Advance(stopwatchIdleTimeout)
+	_, err = load("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.lock.Lock()
+	_, workLoaded := srv.stopwatches[Scope{UserID: 1, Timer: "work"}]
+	_, studyLoaded := srv.stopwatches[Scope{UserID: 1, Timer: "study"}]
+	srv.lock.Unlock()
+
+	if workLoaded || !studyLoaded {
+		t.Errorf("work is loaded %v, study is loaded %v", workLoaded, studyLoaded)
+	}
+
+	// the stopped worker drops events of the stopwatch
+	deadline := time.Now().Add(time.Second)
+	for {
+		srv.hub.lock.Lock()
+		_, ok := srv.hub.histories[work]
+		srv.hub.lock.Unlock()
+
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("worker of unloaded stopwatch is not stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	srv.hub.Unsubscribe(sub)
+	clock.Advance(stopwatchIdleTimeout)
+
+	reloaded, err := load("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded.lock.Lock()
+	defer reloaded.lock.Unlock()
+
+	if reloaded == work || reloaded.Session == nil || !reloaded.Session.Start.Equal(at(0, 12, 0)) {
+		t.Errorf("running session is not loaded again: %+v", reloaded.Session)
+	}
+}
+
+// logBuffer collects log output of workers
+type logBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.String()
+}
+
+func TestClockJumpBackwards(t *testing.T) {
+	logs := &logBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	clock := NewFakeClock(at(1, 9, 0))
+	srv := newTestServer(t, clock, nil)
+	sw := testStopwatch(t, srv)
+
+	err := sw.Start("work", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := srv.hub.Subscribe(sw, -1)
+	defer srv.hub.Unsubscribe(sub)
+
+	// wall clock jumps to the previous day while a minute of real time passes
+	waitSleeping(t, clock)
+	clock.Set(at(0, 23, 0))
+	clock.Advance(time.Minute)
+
+	// and is corrected
+	waitSleeping(t, clock)
+	if !strings.Contains(logs.String(), "wall clock jumped by -10h0m0s") {
+		t.Errorf("jump is not noticed, log:\n%s", logs)
+	}
+
+	checkDayStart(t, sw, at(1, 8, 0))
+	checkSessions(t, srv, span{at(1, 9, 0), time.Time{}})
+
+	clock.Set(at(1, 9, 1))
+	clock.Advance(time.Minute)
+	waitSleeping(t, clock)
+
+	for _, ev := range sub.Take() {
+		if ev.Type == eventDayRolledOver {
+			t.Error("day is rolled over by jumps of wall clock")
+		}
+	}
+
+	for clock.Now().Before(at(2, 8, 0)) {
+		waitSleeping(t, clock)
+		clock.Advance(10 * time.Minute)
+	}
+
+	waitEvent(t, sub, eventDayRolledOver)
+	checkDayStart(t, sw, at(2, 8, 0))
+	checkSessions(t, srv, span{at(1, 9, 0), at(2, 8, 0)}, span{at(2, 8, 0), time.Time{}})
+}
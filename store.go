@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Scope identifies sessions and journal of one stopwatch in a store
+// UserID is 0 for sessions of anonymous user, i.e. when multi-user mode is off
+type Scope struct {
+	UserID int64
+	Timer  string
+}
+
+// Store is a storage backend for sessions.
+// Stopwatch works with sessions only through this interface,
+// so it does not depend on a particular database.
+// All methods except users and migrations work within the scope of the store,
+// a newly opened store has the scope of default stopwatch
+type Store interface {
+	// WithScope returns a store sharing the same database but limited to another scope
+	WithScope(scope Scope) Store
+	// Scope returns the user and stopwatch the store is limited to
+	Scope() Scope
+	// InsertSession saves a new session and sets its ID,
+	// opened sessions are saved with no end. If session already has an ID
+	// (e.g. a deleted session is restored), it is saved with this ID
+	InsertSession(s *Session) error
+	// UpdateSession saves start, end and state of a previously inserted session by its ID
+	UpdateSession(s *Session) error
+	// DeleteSession deletes a session by ID
+	DeleteSession(id int64) error
+	// GetSession returns a session by ID or nil if there is no such session
+	GetSession(id int64) (*Session, error)
+	// SearchSessions returns at most limit sessions which notes contain query,
+	// case-insensitive, latest sessions first
+	SearchSessions(query string, limit int) ([]*Session, error)
+	// LastSession returns the session with the latest start
+	// or nil if there are no sessions at all
+	LastSession() (*Session, error)
+	// Sessions returns sessions started at or after from that are
+	// ended before to or still opened, ordered by start
+	Sessions(from time.Time, to time.Time) ([]*Session, error)
+	// OverlappingSessions returns sessions that have common time with
+	// the interval between from and to, opened sessions never end
+	OverlappingSessions(from time.Time, to time.Time) ([]*Session, error)
+	// InsertAction appends an action to the journal and sets its ID
+	InsertAction(a *Action) error
+	// LastAction returns the latest action that is not undone if undone is false,
+	// or the earliest undone action if undone is true. Returns nil if there is no such action
+	LastAction(undone bool) (*Action, error)
+	// SetActionUndone marks action as undone or redone
+	SetActionUndone(id int64, undone bool) error
+	// DeleteUndoneActions deletes all undone actions, so they can't be redone
+	DeleteUndoneActions() error
+	// TrimActions deletes old actions so that only keep latest actions remain
+	TrimActions(keep int) error
+	// CreateUser saves a new user with a hash of API token and sets its ID
+	CreateUser(u *User) error
+	// UserByTokenHash returns a user by hash of API token or nil if there is no such user
+	UserByTokenHash(tokenHash string) (*User, error)
+	// Users returns all users ordered by name
+	Users() ([]*User, error)
+	// Backup returns all users and sessions of all scopes
+	Backup() (*Backup, error)
+	// Restore saves users and sessions of a valid backup in a single transaction.
+	// Replace deletes all users, sessions and journal first and keeps IDs of backup.
+	// Otherwise backup is merged: users are matched by name, sessions get new IDs
+	// and the ones overlapping with existing sessions of the same stopwatch are skipped
+	Restore(b *Backup, replace bool) (*RestoreResult, error)
+	// Migrate creates schema or upgrades it to the latest version
+	Migrate() error
+	// SchemaVersion returns version of the schema the store currently has
+	SchemaVersion() (int, error)
+	// Close releases resources held by the store
+	Close() error
+}
+
+// storage drivers that can be set in [db] section of config
+const (
+	driverMySQL  = "mysql"
+	driverSQLite = "sqlite"
+	driverMemory = "memory"
+)
+
+// openStore creates a Store for the driver set in config
+func openStore(cfg *DBConfig) (Store, error) {
+	switch cfg.Driver {
+	case driverMySQL, "":
+		dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
+		return openSQLStore(driverMySQL, "mysql", dsn)
+	case driverSQLite:
+		return openSQLStore(driverSQLite, "sqlite3", cfg.Path)
+	case driverMemory:
+		return newMemoryStore(), nil
+	}
+
+	return nil, fmt.Errorf("unknown db driver %q", cfg.Driver)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps sessions in memory only.
+// Everything is lost when the server stops, so it's useful
+// for trying stopwatch out and for tests
+type memoryStore struct {
+	db    *memoryDB
+	scope Scope
+}
+
+// memoryDB holds data of all scopes, IDs are unique across scopes
+type memoryDB struct {
+	lock         sync.Mutex
+	lastID       int64
+	lastActionID int64
+	scopes       map[Scope]*memoryScope
+	users        []User
+}
+
+// memoryScope holds sessions and journal of one stopwatch
+type memoryScope struct {
+	sessions []Session // ordered by start
+	actions  []Action  // ordered by ID
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		db:    &memoryDB{scopes: make(map[Scope]*memoryScope)},
+		scope: Scope{Timer: defaultTimer},
+	}
+}
+
+func (st *memoryStore) WithScope(scope Scope) Store {
+	return &memoryStore{db: st.db, scope: scope}
+}
+
+func (st *memoryStore) Scope() Scope {
+	return st.scope
+}
+
+// lockScope locks the whole memory db and returns data of store's scope
+func (st *memoryStore) lockScope() *memoryScope {
+	st.db.lock.Lock()
+	return st.db.scopeData(st.scope)
+}
+
+// scopeData returns data of a scope creating it if needed, db.lock must be held by caller
+func (db *memoryDB) scopeData(scope Scope) *memoryScope {
+	sc, ok := db.scopes[scope]
+	if !ok {
+		sc = &memoryScope{}
+		db.scopes[scope] = sc
+	}
+
+	return sc
+}
+
+func (st *memoryStore) unlock() {
+	st.db.lock.Unlock()
+}
+
+func (st *memoryStore) InsertSession(s *Session) error {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	if s.ID == 0 {
+		st.db.lastID++
+		s.ID = st.db.lastID
+	} else if s.ID > st.db.lastID {
+		st.db.lastID = s.ID
+	}
+	sc.insert(s)
+
+	return nil
+}
+
+func (st *memoryStore) UpdateSession(s *Session) error {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	for i := range sc.sessions {
+		if sc.sessions[i].ID == s.ID {
+			sc.removeAt(i)
+			sc.insert(s)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (st *memoryStore) DeleteSession(id int64) error {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	for i := range sc.sessions {
+		if sc.sessions[i].ID == id {
+			sc.removeAt(i)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (st *memoryStore) GetSession(id int64) (*Session, error) {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	for i := range sc.sessions {
+		if sc.sessions[i].ID == id {
+			session := sc.sessions[i]
+			return &session, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (st *memoryStore) SearchSessions(query string, limit int) ([]*Session, error) {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	query = strings.ToLower(query)
+
+	var sessions []*Session
+	for i := len(sc.sessions) - 1; i >= 0 && len(sessions) < limit; i-- {
+		if strings.Contains(strings.ToLower(sc.sessions[i].Note), query) {
+			session := sc.sessions[i]
+			sessions = append(sessions, &session)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (st *memoryStore) LastSession() (*Session, error) {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	if len(sc.sessions) == 0 {
+		return nil, nil
+	}
+
+	session := sc.sessions[len(sc.sessions)-1]
+	return &session, nil
+}
+
+func (st *memoryStore) Sessions(from time.Time, to time.Time) ([]*Session, error) {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	var sessions []*Session
+	for i := range sc.sessions {
+		s := sc.sessions[i]
+		if s.Start.Before(from) || (!s.Opened && s.End.After(to)) {
+			continue
+		}
+		sessions = append(sessions, &s)
+	}
+
+	return sessions, nil
+}
+
+func (st *memoryStore) OverlappingSessions(from time.Time, to time.Time) ([]*Session, error) {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	var sessions []*Session
+	for i := range sc.sessions {
+		s := sc.sessions[i]
+		if s.Start.Before(to) && (s.Opened || s.End.After(from)) {
+			sessions = append(sessions, &s)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (st *memoryStore) InsertAction(a *Action) error {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	st.db.lastActionID++
+	a.ID = st.db.lastActionID
+	sc.actions = append(sc.actions, *a)
+
+	return nil
+}
+
+func (st *memoryStore) LastAction(undone bool) (*Action, error) {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	if undone {
+		for i := range sc.actions {
+			if sc.actions[i].Undone {
+				a := sc.actions[i]
+				return &a, nil
+			}
+		}
+	} else {
+		for i := len(sc.actions) - 1; i >= 0; i-- {
+			if !sc.actions[i].Undone {
+				a := sc.actions[i]
+				return &a, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (st *memoryStore) SetActionUndone(id int64, undone bool) error {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	for i := range sc.actions {
+		if sc.actions[i].ID == id {
+			sc.actions[i].Undone = undone
+		}
+	}
+
+	return nil
+}
+
+func (st *memoryStore) DeleteUndoneActions() error {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	actions := sc.actions[:0]
+	for _, a := range sc.actions {
+		if !a.Undone {
+			actions = append(actions, a)
+		}
+	}
+	sc.actions = actions
+
+	return nil
+}
+
+func (st *memoryStore) TrimActions(keep int) error {
+	sc := st.lockScope()
+	defer st.unlock()
+
+	if len(sc.actions) > keep {
+		sc.actions = append([]Action(nil), sc.actions[len(sc.actions)-keep:]...)
+	}
+
+	return nil
+}
+
+func (st *memoryStore) CreateUser(u *User) error {
+	st.db.lock.Lock()
+	defer st.db.lock.Unlock()
+
+	for _, other := range st.db.users {
+		if other.Name == u.Name {
+			return fmt.Errorf("user %s already exists", u.Name)
+		}
+	}
+
+	u.ID = 1
+	for _, other := range st.db.users {
+		if other.ID >= u.ID {
+			u.ID = other.ID + 1
+		}
+	}
+	st.db.users = append(st.db.users, *u)
+
+	return nil
+}
+
+func (st *memoryStore) UserByTokenHash(tokenHash string) (*User, error) {
+	st.db.lock.Lock()
+	defer st.db.lock.Unlock()
+
+	for _, u := range st.db.users {
+		if u.TokenHash == tokenHash {
+			return &u, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (st *memoryStore) Users() ([]*User, error) {
+	st.db.lock.Lock()
+	defer st.db.lock.Unlock()
+
+	users := make([]*User, len(st.db.users))
+	for i := range st.db.users {
+		u := st.db.users[i]
+		users[i] = &u
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+
+	return users, nil
+}
+
+func (st *memoryStore) Backup() (*Backup, error) {
+	st.db.lock.Lock()
+	defer st.db.lock.Unlock()
+
+	b := newBackup()
+	for _, u := range st.db.users {
+		b.Users = append(b.Users, BackupUser{ID: u.ID, Name: u.Name, TokenHash: u.TokenHash, Created: millis(u.Created)})
+	}
+
+	scopes := make([]Scope, 0, len(st.db.scopes))
+	for scope := range st.db.scopes {
+		scopes = append(scopes, scope)
+	}
+
+	sort.Slice(scopes, func(i, j int) bool {
+		if scopes[i].UserID != scopes[j].UserID {
+			return scopes[i].UserID < scopes[j].UserID
+		}
+		return scopes[i].Timer < scopes[j].Timer
+	})
+
+	for _, scope := range scopes {
+		sc := st.db.scopes[scope]
+		for i := range sc.sessions {
+			b.Sessions = append(b.Sessions, backupSession(scope, &sc.sessions[i]))
+		}
+	}
+
+	return b, nil
+}
+
+func (st *memoryStore) Restore(b *Backup, replace bool) (*RestoreResult, error) {
+	st.db.lock.Lock()
+	defer st.db.lock.Unlock()
+
+	result := &RestoreResult{}
+	userIDs := map[int64]int64{0: 0}
+
+	if replace {
+		st.db.users = nil
+		st.db.scopes = make(map[Scope]*memoryScope)
+	}
+
+	for _, bu := range b.Users {
+		u := User{ID: bu.ID, Name: bu.Name, TokenHash: bu.TokenHash, Created: millisToTime(bu.Created)}
+
+		found := false
+		for _, other := range st.db.users {
+			if other.Name == u.Name {
+				userIDs[bu.ID] = other.ID
+				found = true
+			}
+		}
+
+		if found {
+			continue
+		}
+
+		if !replace {
+			u.ID = 1
+			for _, other := range st.db.users {
+				if other.ID >= u.ID {
+					u.ID = other.ID + 1
+				}
+			}
+		}
+
+		st.db.users = append(st.db.users, u)
+		userIDs[bu.ID] = u.ID
+		result.Users++
+	}
+
+	now := time.Now()
+	for _, bs := range b.Sessions {
+		sc := st.db.scopeData(Scope{UserID: userIDs[bs.UserID], Timer: bs.Timer})
+		session := bs.Session()
+
+		if replace {
+			if session.ID > st.db.lastID {
+				st.db.lastID = session.ID
+			}
+		} else {
+			end := session.End
+			if session.Opened {
+				end = now
+			}
+
+			overlaps := false
+			for _, other := range sc.sessions {
+				if other.Start.Before(end) && (other.Opened || other.End.After(session.Start)) {
+					overlaps = true
+					break
+				}
+			}
+
+			if overlaps {
+				result.Skipped++
+				continue
+			}
+
+			st.db.lastID++
+			session.ID = st.db.lastID
+		}
+
+		sc.insert(session)
+		result.Sessions++
+	}
+
+	return result, nil
+}
+
+func (st *memoryStore) Close() error {
+	return nil
+}
+
+// Migrate does nothing, memory store has no schema
+func (st *memoryStore) Migrate() error {
+	return nil
+}
+
+// SchemaVersion is always the latest one for memory store
+func (st *memoryStore) SchemaVersion() (int, error) {
+	return latestSchemaVersion(), nil
+}
+
+// insert puts a copy of session to the sessions slice keeping it ordered by start
+func (sc *memoryScope) insert(s *Session) {
+	i := sort.Search(len(sc.sessions), func(i int) bool {
+		return sc.sessions[i].Start.After(s.Start)
+	})
+
+	sc.sessions = append(sc.sessions, Session{})
+	copy(sc.sessions[i+1:], sc.sessions[i:])
+	sc.sessions[i] = *s
+}
+
+func (sc *memoryScope) removeAt(i int) {
+	sc.sessions = append(sc.sessions[:i], sc.sessions[i+1:]...)
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore is a Store backed by an SQL database (MySQL or SQLite)
+// dialect is driverMySQL or driverSQLite
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+	scope   Scope
+}
+
+// scopeColumns are columns of sessions and actions tables holding the scope,
+// scopeFilter limits a query to the scope of the store.
+// Values for both of them are returned by scopeArgs
+const (
+	scopeColumns      = "user_id, timer"
+	scopePlaceholders = "?, ?"
+	scopeFilter       = "user_id = ? and timer = ?"
+)
+
+// scopeArgs returns values of scope columns followed by args
+func (st *sqlStore) scopeArgs(args ...interface{}) []interface{} {
+	return append([]interface{}{st.scope.UserID, st.scope.Timer}, args...)
+}
+
+func openSQLStore(dialect string, driverName string, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlStore{db: db, dialect: dialect, scope: Scope{Timer: defaultTimer}}, nil
+}
+
+func (st *sqlStore) WithScope(scope Scope) Store {
+	scoped := *st
+	scoped.scope = scope
+	return &scoped
+}
+
+func (st *sqlStore) Scope() Scope {
+	return st.scope
+}
+
+func (st *sqlStore) InsertSession(s *Session) error {
+	if s.ID != 0 {
+		_, err := st.db.Exec("insert into sessions ("+scopeColumns+", id, start, end, project, tags, note) values ("+scopePlaceholders+", ?, ?, ?, ?, ?, ?)", st.scopeArgs(s.ID, millis(s.Start), nullableEnd(s), s.Project, joinTags(s.Tags), s.Note)...)
+		return err
+	}
+
+	res, err := st.db.Exec("insert into sessions ("+scopeColumns+", start, end, project, tags, note) values ("+scopePlaceholders+", ?, ?, ?, ?, ?)", st.scopeArgs(millis(s.Start), nullableEnd(s), s.Project, joinTags(s.Tags), s.Note)...)
+	if err != nil {
+		return err
+	}
+
+	s.ID, err = res.LastInsertId()
+	return err
+}
+
+func (st *sqlStore) UpdateSession(s *Session) error {
+	values := []interface{}{millis(s.Start), nullableEnd(s), s.Project, joinTags(s.Tags), s.Note}
+	_, err := st.db.Exec("update sessions set start = ?, end = ?, project = ?, tags = ?, note = ? where "+scopeFilter+" and id = ?", append(values, st.scopeArgs(s.ID)...)...)
+	return err
+}
+
+func (st *sqlStore) DeleteSession(id int64) error {
+	_, err := st.db.Exec("delete from sessions where "+scopeFilter+" and id = ?", st.scopeArgs(id)...)
+	return err
+}
+
+func (st *sqlStore) GetSession(id int64) (*Session, error) {
+	row := st.db.QueryRow("select "+sessionColumns+" from sessions where "+scopeFilter+" and id = ?", st.scopeArgs(id)...)
+	session, err := scanSession(row)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return session, err
+}
+
+func (st *sqlStore) SearchSessions(query string, limit int) ([]*Session, error) {
+	pattern := "%" + likeEscaper.Replace(strings.ToLower(query)) + "%"
+	rows, err := st.db.Query("select "+sessionColumns+" from sessions where "+scopeFilter+" and lower(note) like ? escape '!' order by start desc limit ?", st.scopeArgs(pattern, limit)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSessions(rows)
+}
+
+// likeEscaper escapes wildcards of LIKE pattern, ! is used as escape character
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+func (st *sqlStore) LastSession() (*Session, error) {
+	row := st.db.QueryRow("select "+sessionColumns+" from sessions where "+scopeFilter+" order by start desc, id desc limit 1", st.scopeArgs()...)
+	session, err := scanSession(row)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return session, err
+}
+
+func (st *sqlStore) Sessions(from time.Time, to time.Time) ([]*Session, error) {
+	rows, err := st.db.Query("select "+sessionColumns+" from sessions where "+scopeFilter+" and start >= ? and (end <= ? or end is NULL) order by start, id", st.scopeArgs(millis(from), millis(to))...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSessions(rows)
+}
+
+func (st *sqlStore) OverlappingSessions(from time.Time, to time.Time) ([]*Session, error) {
+	rows, err := st.db.Query("select "+sessionColumns+" from sessions where "+scopeFilter+" and start < ? and (end > ? or end is NULL) order by start, id", st.scopeArgs(millis(to), millis(from))...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanSessions(rows)
+}
+
+func (st *sqlStore) InsertAction(a *Action) error {
+	changes, err := json.Marshal(a.Changes)
+	if err != nil {
+		return err
+	}
+
+	res, err := st.db.Exec("insert into actions ("+scopeColumns+", kind, created, changes, undone) values ("+scopePlaceholders+", ?, ?, ?, ?)", st.scopeArgs(a.Kind, millis(a.Created), string(changes), a.Undone)...)
+	if err != nil {
+		return err
+	}
+
+	a.ID, err = res.LastInsertId()
+	return err
+}
+
+func (st *sqlStore) LastAction(undone bool) (*Action, error) {
+	query := "select id, kind, created, changes, undone from actions where " + scopeFilter + " and undone = ? order by id desc limit 1"
+	if undone {
+		query = "select id, kind, created, changes, undone from actions where " + scopeFilter + " and undone = ? order by id limit 1"
+	}
+
+	var created int64
+	var changes string
+	a := &Action{}
+
+	err := st.db.QueryRow(query, st.scopeArgs(undone)...).Scan(&a.ID, &a.Kind, &created, &changes, &a.Undone)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.Created = millisToTime(created)
+
+	err = json.Unmarshal([]byte(changes), &a.Changes)
+	if err != nil {
+		return nil, fmt.Errorf("parse changes of action %d: %s", a.ID, err)
+	}
+
+	return a, nil
+}
+
+func (st *sqlStore) SetActionUndone(id int64, undone bool) error {
+	values := []interface{}{undone}
+	_, err := st.db.Exec("update actions set undone = ? where "+scopeFilter+" and id = ?", append(values, st.scopeArgs(id)...)...)
+	return err
+}
+
+func (st *sqlStore) DeleteUndoneActions() error {
+	_, err := st.db.Exec("delete from actions where "+scopeFilter+" and undone = ?", st.scopeArgs(true)...)
+	return err
+}
+
+func (st *sqlStore) TrimActions(keep int) error {
+	var lastRemoved int64
+	err := st.db.QueryRow("select id from actions where "+scopeFilter+" order by id desc limit 1 offset ?", st.scopeArgs(keep)...).Scan(&lastRemoved)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = st.db.Exec("delete from actions where "+scopeFilter+" and id <= ?", st.scopeArgs(lastRemoved)...)
+	return err
+}
+
+func (st *sqlStore) CreateUser(u *User) error {
+	res, err := st.db.Exec("insert into users (name, token_hash, created) values (?, ?, ?)", u.Name, u.TokenHash, millis(u.Created))
+	if err != nil {
+		return err
+	}
+
+	u.ID, err = res.LastInsertId()
+	return err
+}
+
+func (st *sqlStore) UserByTokenHash(tokenHash string) (*User, error) {
+	row := st.db.QueryRow("select id, name, token_hash, created from users where token_hash = ?", tokenHash)
+	u, err := scanUser(row)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return u, err
+}
+
+func (st *sqlStore) Users() ([]*User, error) {
+	rows, err := st.db.Query("select id, name, token_hash, created from users order by name")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var created int64
+	u := &User{}
+
+	err := row.Scan(&u.ID, &u.Name, &u.TokenHash, &created)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Created = millisToTime(created)
+	return u, nil
+}
+
+func (st *sqlStore) Backup() (*Backup, error) {
+	// read everything in one transaction to get a consistent copy
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	b := newBackup()
+
+	rows, err := tx.Query("select id, name, token_hash, created from users order by id")
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.Users = append(b.Users, BackupUser{ID: u.ID, Name: u.Name, TokenHash: u.TokenHash, Created: millis(u.Created)})
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query("select " + scopeColumns + ", " + sessionColumns + " from sessions order by user_id, timer, start, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		scope := Scope{}
+		session, err := scanSession(prefixScanner{row: rows, prefix: []interface{}{&scope.UserID, &scope.Timer}})
+		if err != nil {
+			return nil, err
+		}
+		b.Sessions = append(b.Sessions, backupSession(scope, session))
+	}
+
+	return b, rows.Err()
+}
+
+func (st *sqlStore) Restore(b *Backup, replace bool) (*RestoreResult, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := &RestoreResult{}
+	userIDs := map[int64]int64{0: 0}
+
+	if replace {
+		for _, table := range []string{"actions", "sessions", "users"} {
+			_, err = tx.Exec("delete from " + table)
+			if err != nil {
+				return nil, fmt.Errorf("clear %s: %s", table, err)
+			}
+		}
+	}
+
+	for _, u := range b.Users {
+		if replace {
+			_, err = tx.Exec("insert into users (id, name, token_hash, created) values (?, ?, ?, ?)", u.ID, u.Name, u.TokenHash, u.Created)
+			if err != nil {
+				return nil, fmt.Errorf("restore user %s: %s", u.Name, err)
+			}
+			userIDs[u.ID] = u.ID
+			result.Users++
+			continue
+		}
+
+		var id int64
+		err = tx.QueryRow("select id from users where name = ?", u.Name).Scan(&id)
+		if err == sql.ErrNoRows {
+			var res sql.Result
+			res, err = tx.Exec("insert into users (name, token_hash, created) values (?, ?, ?)", u.Name, u.TokenHash, u.Created)
+			if err == nil {
+				id, err = res.LastInsertId()
+			}
+			result.Users++
+		}
+		if err != nil {
+			return nil, fmt.Errorf("restore user %s: %s", u.Name, err)
+		}
+		userIDs[u.ID] = id
+	}
+
+	now := millis(time.Now())
+	for _, bs := range b.Sessions {
+		s := bs.Session()
+		scopeArgs := []interface{}{userIDs[bs.UserID], bs.Timer}
+
+		if replace {
+			_, err = tx.Exec("insert into sessions ("+scopeColumns+", id, start, end, project, tags, note) values ("+scopePlaceholders+", ?, ?, ?, ?, ?, ?)", append(scopeArgs, s.ID, millis(s.Start), nullableEnd(s), s.Project, joinTags(s.Tags), s.Note)...)
+		} else {
+			end := now
+			if bs.End != nil {
+				end = *bs.End
+			}
+
+			var overlapping int
+			err = tx.QueryRow("select count(*) from sessions where "+scopeFilter+" and start < ? and (end > ? or end is NULL)", append(scopeArgs, end, bs.Start)...).Scan(&overlapping)
+			if err == nil && overlapping > 0 {
+				result.Skipped++
+				continue
+			}
+
+			if err == nil {
+				_, err = tx.Exec("insert into sessions ("+scopeColumns+", start, end, project, tags, note) values ("+scopePlaceholders+", ?, ?, ?, ?, ?)", append(scopeArgs, millis(s.Start), nullableEnd(s), s.Project, joinTags(s.Tags), s.Note)...)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("restore session %d: %s", bs.ID, err)
+		}
+		result.Sessions++
+	}
+
+	return result, tx.Commit()
+}
+
+func (st *sqlStore) Close() error {
+	return st.db.Close()
+}
+
+// Migrate creates schema_version table if needed and
+// applies all migrations newer than current schema version
+func (st *sqlStore) Migrate() error {
+	_, err := st.db.Exec("create table if not exists schema_version (version integer not null primary key, applied_at bigint not null)")
+	if err != nil {
+		return fmt.Errorf("create schema_version table: %s", err)
+	}
+
+	current, err := st.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		// migration statements and version are committed together,
+		// except MySQL DDL, which is why MySQL migrations have one statement
+		tx, err := st.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		for _, stmt := range m.statements(st.dialect) {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s): %s", m.version, m.description, err)
+			}
+		}
+
+		_, err = tx.Exec("insert into schema_version (version, applied_at) values (?, ?)", m.version, millis(time.Now()))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: save version: %s", m.version, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("migration %d: commit: %s", m.version, err)
+		}
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the latest applied migration version
+// or 0 if migrations were never applied
+func (st *sqlStore) SchemaVersion() (int, error) {
+	var hasTable bool
+	var err error
+
+	if st.dialect == driverSQLite {
+		err = st.db.QueryRow("select count(*) > 0 from sqlite_master where type = 'table' and name = 'schema_version'").Scan(&hasTable)
+	} else {
+		err = st.db.QueryRow("select count(*) > 0 from information_schema.tables where table_schema = database() and table_name = 'schema_version'").Scan(&hasTable)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("check schema_version table: %s", err)
+	}
+
+	if !hasTable {
+		return 0, nil
+	}
+
+	var version int
+	err = st.db.QueryRow("select coalesce(max(version), 0) from schema_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("select schema version: %s", err)
+	}
+
+	return version, nil
+}
+
+// sessionColumns are columns of sessions table in the order scanSession expects them
+const sessionColumns = "id, start, end, project, tags, note"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// prefixScanner scans leading columns of a row into prefix,
+// so that scanSession can read rows with scope columns
+type prefixScanner struct {
+	row    rowScanner
+	prefix []interface{}
+}
+
+func (p prefixScanner) Scan(dest ...interface{}) error {
+	return p.row.Scan(append(p.prefix, dest...)...)
+}
+
+func scanSession(row rowScanner) (*Session, error) {
+	var id int64
+	var start int64
+	var end sql.NullInt64 // end is NULL for opened sessions
+	var project string
+	var tags string
+	var note string
+
+	err := row.Scan(&id, &start, &end, &project, &tags, &note)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		ID:      id,
+		Start:   millisToTime(start),
+		Project: project,
+		Tags:    parseTags(tags),
+		Note:    note,
+	}
+
+	if end.Valid {
+		session.End = millisToTime(end.Int64)
+	} else {
+		session.Opened = true
+	}
+
+	return session, nil
+}
+
+// scanSessions reads all sessions from rows and closes them
+func scanSessions(rows *sql.Rows) ([]*Session, error) {
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// nullableEnd returns end of session in milliseconds or NULL if session is opened
+func nullableEnd(s *Session) sql.NullInt64 {
+	if s.Opened {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: millis(s.End), Valid: true}
+}
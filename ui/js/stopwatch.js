@@ -1,26 +1,11 @@
 $(function() {
-    var stopwatchPage = true;
-    var startHour = window.DayStartHour;
-
-    var getDayStart = function(date) {
-        if (date.getHours() < startHour) {
-            date = new Date(date.getTime() - 86400000);
-        }
-        date.setHours(startHour);
-        date.setMinutes(0);
-        date.setSeconds(0);
-        return date;
-    }
+    // bounds of the day shown on the page are computed by server,
+    // as days start at configured time in configured time zone
+    var pageDayStart = new Date(window.DayStart);
+    var pageDayEnd = window.DayEnd;
 
     var urlSplit = location.pathname.split("/");
-    var pageDayStart = null;
-    if (m = urlSplit[urlSplit.length-2].match(/^(\d{4})-(\d{2})-(\d{2})$/)) {
-        pageDayStart = new Date(m[1], m[2]-1, m[3], startHour, 0, 0);
-        stopwatchPage = false;
-    }
-    else {
-        pageDayStart = getDayStart(new Date());
-    }
+    var stopwatchPage = !urlSplit[urlSplit.length-2].match(/^(\d{4})-(\d{2})-(\d{2})$/);
 
     var getDurationString = function(microseconds) {
         var micro = parseInt(microseconds % 1000);
@@ -76,20 +61,24 @@ $(function() {
         running = !running;
     }
 
+    // applyState shows stopwatch state returned by API or sent in events
+    var applyState = function(state) {
+        elapsedTime = state.time;
+        displayTime(state.time);
+        if (state.running != running) {
+            toggle();
+            if (!state.running) {
+                redrawSessions();
+            }
+        }
+    }
+
     var request = function(action) {
         $.ajax({
-            url: StopwatchPrefix + "/" + action,
+            url: StopwatchPrefix + "/api/v2/" + action,
+            method: action == "time" ? "GET" : "POST",
             dataType: "json",
-            success: function(response) {
-                elapsedTime = response.time;
-                displayTime(response.time);
-                if (response.running != running) {
-                    toggle();
-                    if (!response.running) {
-                        redrawSessions();
-                    }
-                }
-            },
+            success: applyState,
         });
     }
 
@@ -98,7 +87,7 @@ $(function() {
     }
 
     var redrawSessions = function() {
-        var url = StopwatchPrefix + "/sessions";
+        var url = StopwatchPrefix + "/api/v2/sessions";
         if (!stopwatchPage) {
             url += "?time=" + pageDayStart.getTime()
         }
@@ -111,7 +100,7 @@ $(function() {
                 timeline.children("div").remove();
 
                 dayStart = pageDayStart;
-                var endTime = Math.min(new Date().getTime() + 100000, dayStart.getTime() + 86400000);
+                var endTime = Math.min(new Date().getTime() + 100000, pageDayEnd);
                 var zeroPoint = dayStart.getTime();
 
                 for (var ts = dayStart.getTime(); ts < endTime; ts += 3600000) {
@@ -152,6 +141,15 @@ $(function() {
                     console.log("zero point " + zeroPoint);
                     var titleText = new Date(sessions[i].start) + " - " + new Date(sessionEnd);
                     titleText += " duration: " + getDurationString(sessionEnd - sessions[i].start);
+                    if (sessions[i].project) {
+                        titleText += "\nproject: " + sessions[i].project;
+                    }
+                    if (sessions[i].tags && sessions[i].tags.length > 0) {
+                        titleText += "\ntags: " + sessions[i].tags.join(", ");
+                    }
+                    if (sessions[i].note) {
+                        titleText += "\n" + sessions[i].note;
+                    }
 
                     $("<div>").addClass("work")
                         .css("width", pixData[1] + "%")
@@ -173,13 +171,26 @@ $(function() {
                 request("start");
             }
         });
-        // subscribe to updates over websocket:
+        // subscribe to events, the first one is the current state,
+        // EventSource reconnects by itself and resumes with Last-Event-ID
         (function() {
-            var updatesSocket = new WebSocket("ws://" + location.host + StopwatchPrefix + "/updates");
-
-            updatesSocket.onmessage = function(event) {
-                request("time");
+            var events = new EventSource(StopwatchPrefix + "/api/v2/events");
+            var onEvent = function(message) {
+                var event = JSON.parse(message.data);
+                var dayChanged = event.data.day_start != pageDayStart.getTime();
+                if (dayChanged) {
+                    pageDayStart = new Date(event.data.day_start);
+                    pageDayEnd = event.data.day_end;
+                }
+                applyState(event.data);
+                if (dayChanged || event.type == "session_edited") {
+                    redrawSessions();
+                }
             }
+
+            ["state", "started", "stopped", "day_rolled_over", "session_edited"].forEach(function(type) {
+                events.addEventListener(type, onEvent);
+            });
         })()
     }
 });
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// name of cookie that keeps API token for browsers
+const tokenCookie = "stopwatch_token"
+
+// User is a person sharing stopwatch server with others, identified by API token.
+// Only SHA-256 hash of the token is stored.
+// User with ID 0 is the anonymous user that owns all sessions in single-user mode
+type User struct {
+	ID        int64
+	Name      string
+	TokenHash string
+	Created   time.Time
+}
+
+// generateToken returns a new random API token
+func generateToken() (string, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenFromRequest returns API token from Authorization header,
+// token parameter or cookie, in that order.
+// Cookie is not accepted by legacy actions, see cookieAllowed
+func tokenFromRequest(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+
+	if !cookieAllowed(r) {
+		return ""
+	}
+
+	if cookie, err := r.Cookie(tokenCookie); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// cookieAllowed tells if request may be authenticated with token cookie.
+// Legacy actions changing stopwatch state accept GET, so a link or an image
+// on another page would be able to run them with the cookie of UI
+func cookieAllowed(r *http.Request) bool {
+	_, p, _ := splitTimerPath(r.URL.Path)
+
+	switch p {
+	case "/start", "/stop", "/undo", "/redo":
+		return false
+	}
+
+	return true
+}
+
+// authenticate returns the user who made the request. In single-user mode
+// it's always the anonymous user. In multi-user mode it writes
+// 401 response and returns nil if there is no valid token in the request.
+// A token passed as parameter is saved to cookie so that browsers
+// send it with API requests made by UI
+func (srv *Server) authenticate(w http.ResponseWriter, r *http.Request) *User {
+	if !srv.config.HTTP.MultiUser {
+		return &User{}
+	}
+
+	token := tokenFromRequest(r)
+	if token == "" {
+		unauthorized(w, "API token required")
+		return nil
+	}
+
+	user, err := srv.store.UserByTokenHash(hashToken(token))
+	if err != nil {
+		writeInternalError(w, "failed to load user", err)
+		return nil
+	}
+
+	if user == nil {
+		unauthorized(w, "invalid API token")
+		return nil
+	}
+
+	srv.rememberToken(w, r, token)
+	return user
+}
+
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="stopwatch"`)
+	writeError(w, http.StatusUnauthorized, errCodeUnauthorized, msg)
+}
+
+// runAddUser creates a user and prints its API token, used in -add-user mode
+func runAddUser(cfg *DBConfig, name string) error {
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	err = store.Migrate()
+	if err != nil {
+		return err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return fmt.Errorf("generate token: %s", err)
+	}
+
+	user := &User{
+		Name:      name,
+		TokenHash: hashToken(token),
+		Created:   time.Now(),
+	}
+
+	err = store.CreateUser(user)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("user %s created with id %d\n", user.Name, user.ID)
+	fmt.Printf("API token (it is not stored and can't be shown again): %s\n", token)
+
+	return nil
+}
+
+// printUsers prints all users, used in -users mode
+func printUsers(cfg *DBConfig) error {
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	users, err := store.Users()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		fmt.Printf("%4d  %-20s created %s\n", user.ID, user.Name, user.Created.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -13,19 +14,66 @@ func millisToTime(m int64) time.Time {
 	return time.Unix(m/1000, (m%1000)*1000000)
 }
 
-const startMinute = 0
+// dayStart returns start of the day containing t in time zone of config.
+// Days are counted by calendar dates rather than 24 hours,
+// so days of daylight saving time changes are 23 or 25 hours long.
+// A day lasts until start of the next date, which may be at other
+// time of day if start of its weekday is overridden
+func dayStart(t time.Time, cfg *StopwatchConfig) time.Time {
+	t = t.In(cfg.Location())
 
-func dayStart(t time.Time, startHour int) time.Time {
-	if t.Hour() < startHour || (t.Hour() == startHour && t.Minute() < startMinute) {
-		t = t.Add(time.Hour * -24)
+	start := dateDayStart(t, cfg)
+	if t.Before(start) {
+		year, month, day := t.Date()
+		start = dateDayStart(time.Date(year, month, day-1, 12, 0, 0, 0, t.Location()), cfg)
 	}
-	year, month, day := t.Date()
-	return time.Date(year, month, day, startHour, startMinute, 0, 0, t.Location())
+
+	return start
+}
+
+// dateDayStart returns start of the day of a calendar date
+func dateDayStart(date time.Time, cfg *StopwatchConfig) time.Time {
+	year, month, day := date.Date()
+	loc := cfg.Location()
+
+	// weekday is taken at noon as midnight may not exist on DST change
+	minutes := cfg.dayStartMinutes(time.Date(year, month, day, 12, 0, 0, 0, loc).Weekday())
+	start := time.Date(year, month, day, minutes/60, minutes%60, 0, 0, loc)
+
+	// time skipped on DST change is shifted by length of the gap,
+	// the day starts at the end of the gap instead, when the time is passed
+	if start.Hour()*60+start.Minute() != minutes {
+		start, _ = start.ZoneBounds()
+	}
+
+	return start
 }
 
-func dayEnd(t time.Time, startHour int) time.Time {
-	t = t.Add(time.Hour * 24)
-	return dayStart(t, startHour)
+// dayEnd returns end of the day containing t, it's start of the next date
+func dayEnd(t time.Time, cfg *StopwatchConfig) time.Time {
+	year, month, day := dayStart(t, cfg).Date()
+	return dateDayStart(time.Date(year, month, day+1, 12, 0, 0, 0, cfg.Location()), cfg)
+}
+
+// parseClockTime parses time of day in HH:MM format, returns minutes from midnight
+func parseClockTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, must be in HH:MM format", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseWeekday returns a weekday by its English name, case-insensitive
+func parseWeekday(name string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), name) {
+			return day, nil
+		}
+	}
+
+	return time.Sunday, fmt.Errorf("invalid weekday %s", name)
 }
 
 func apiDateFormat(t time.Time) string {
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func berlinConfig(t *testing.T, start string) *StopwatchConfig {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+
+	cfg := &StopwatchConfig{DayStart: start, location: loc}
+	err = cfg.parseDayStarts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cfg
+}
+
+func TestDaysOfDSTChange(t *testing.T) {
+	tests := []struct {
+		dayStart string
+		t        string // local time in Berlin
+		start    string
+		end      string
+		length   time.Duration
+	}{
+		// clocks go forward from 02:00 to 03:00 on 2024-03-31
+		{"00:00", "2024-03-31 12:00", "2024-03-31 00:00 +0100", "2024-04-01 00:00 +0200", 23 * time.Hour},
+		{"08:00", "2024-03-31 07:00", "2024-03-30 08:00 +0100", "2024-03-31 08:00 +0200", 23 * time.Hour},
+		{"08:00", "2024-03-31 08:00", "2024-03-31 08:00 +0200", "2024-04-01 08:00 +0200", 24 * time.Hour},
+		// and back from 03:00 to 02:00 on 2024-10-27
+		{"00:00", "2024-10-27 12:00", "2024-10-27 00:00 +0200", "2024-10-28 00:00 +0100", 25 * time.Hour},
+		{"08:00", "2024-10-27 07:59", "2024-10-26 08:00 +0200", "2024-10-27 08:00 +0100", 25 * time.Hour},
+		{"04:30", "2024-10-27 02:30 +0100", "2024-10-26 04:30 +0200", "2024-10-27 04:30 +0100", 25 * time.Hour},
+		// day start in the skipped hour is moved to its end, not by its length
+		{"02:30", "2024-03-31 03:10", "2024-03-31 03:00 +0200", "2024-04-01 02:30 +0200", 23*time.Hour + 30*time.Minute},
+		{"02:30", "2024-03-31 01:59", "2024-03-30 02:30 +0100", "2024-03-31 03:00 +0200", 23*time.Hour + 30*time.Minute},
+		// day start in the repeated hour is the second of the two
+		{"02:30", "2024-10-27 02:40 +0200", "2024-10-26 02:30 +0200", "2024-10-27 02:30 +0100", 25 * time.Hour},
+		{"02:30", "2024-10-27 02:40 +0100", "2024-10-27 02:30 +0100", "2024-10-28 02:30 +0100", 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		cfg := berlinConfig(t, test.dayStart)
+
+		tm := parseTestTime(t, test.t, cfg.Location())
+		start := dayStart(tm, cfg)
+		end := dayEnd(tm, cfg)
+
+		expectedStart := parseTestTime(t, test.start, cfg.Location())
+		expectedEnd := parseTestTime(t, test.end, cfg.Location())
+
+		if !start.Equal(expectedStart) || !end.Equal(expectedEnd) {
+			t.Errorf("day of %s with day start %s is %s - %s, expected %s - %s", test.t, test.dayStart, start, end, expectedStart, expectedEnd)
+		}
+
+		if end.Sub(start) != test.length {
+			t.Errorf("day of %s with day start %s is %s long, expected %s", test.t, test.dayStart, end.Sub(start), test.length)
+		}
+
+		// days follow each other without gaps
+		if !dayStart(end, cfg).Equal(end) || !dayEnd(start.Add(-time.Nanosecond), cfg).Equal(start) {
+			t.Errorf("day of %s with day start %s doesn't adjoin neighbour days", test.t, test.dayStart)
+		}
+	}
+}
+
+// parseTestTime parses time with optional zone offset, which is needed
+// in the repeated hour of DST change
+func parseTestTime(t *testing.T, value string, loc *time.Location) time.Time {
+	layout := "2006-01-02 15:04"
+	if len(value) > len(layout) {
+		layout += " -0700"
+	}
+
+	tm, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tm
+}
+
+func TestWeekdayDayStart(t *testing.T) {
+	cfg := &StopwatchConfig{DayStart: "04:30", WeekdayDayStart: map[string]string{"Saturday": "10:00"}, location: time.UTC}
+	err := cfg.parseDayStarts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		t     string
+		start string
+		end   string
+	}{
+		// friday lasts until the late start of saturday
+		{"2024-05-10 12:00", "2024-05-10 04:30", "2024-05-11 10:00"},
+		{"2024-05-11 09:59", "2024-05-10 04:30", "2024-05-11 10:00"},
+		{"2024-05-11 10:00", "2024-05-11 10:00", "2024-05-12 04:30"},
+		{"2024-05-12 04:00", "2024-05-11 10:00", "2024-05-12 04:30"},
+	}
+
+	for _, test := range tests {
+		tm := parseTestTime(t, test.t, time.UTC)
+		start := dayStart(tm, cfg)
+		end := dayEnd(tm, cfg)
+
+		if !start.Equal(parseTestTime(t, test.start, time.UTC)) || !end.Equal(parseTestTime(t, test.end, time.UTC)) {
+			t.Errorf("day of %s is %s - %s, expected %s - %s", test.t, start, end, test.start, test.end)
+		}
+	}
+}